@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"url-shortener/internal/config"
+	"url-shortener/internal/middleware/auth"
+	"url-shortener/internal/storage/postgres"
+)
+
+func main() {
+	owner := flag.String("owner", "", "owner name to issue a new API key for")
+	revoke := flag.String("revoke", "", "API key to revoke")
+
+	flag.Parse()
+
+	if (*owner == "") == (*revoke == "") {
+		log.Fatal("Exactly one of -owner or -revoke is required")
+	}
+
+	cfg := config.Load()
+
+	db, err := postgres.StartDB(&cfg)
+
+	if err != nil {
+		log.Fatal("Postgres connection failed: ", err)
+	}
+
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DB.Timeout)
+	defer cancel()
+
+	if *revoke != "" {
+		err = db.RevokeApiKey(ctx, auth.HashKey(*revoke))
+
+		if err != nil {
+			log.Fatal("Failed to revoke API key: ", err)
+		}
+
+		fmt.Println("API key revoked")
+		return
+	}
+
+	key, err := auth.GenerateKey()
+
+	if err != nil {
+		log.Fatal("Failed to generate API key: ", err)
+	}
+
+	ownerID, err := db.CreateApiKey(ctx, *owner, auth.HashKey(key))
+
+	if err != nil {
+		log.Fatal("Failed to store API key: ", err)
+	}
+
+	fmt.Printf("Owner: %s (id %d)\nAPI key: %s\n", *owner, ownerID, key)
+}
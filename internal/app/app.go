@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"net/http"
 	_ "net/http/pprof"
@@ -12,6 +13,7 @@ import (
 	"url-shortener/internal/kafka"
 	"url-shortener/internal/logger"
 	"url-shortener/internal/metrics"
+	"url-shortener/internal/safety"
 	"url-shortener/internal/storage"
 	"url-shortener/internal/storage/postgres"
 	redis_ "url-shortener/internal/storage/redis"
@@ -26,6 +28,8 @@ type App struct {
 	Cache    storage.Cache
 	Logger   logger.Logger
 	Producer *kafka.KafkaProducer
+	Safety   safety.SafetyChecker
+	Recheck  safety.SafetyChecker
 }
 
 func New(cfg config.Config, logger logger.Logger) *App {
@@ -68,6 +72,8 @@ func (a *App) Run() {
 
 	go workers.Scheduler(ctx, a.DB, a.Cache, a.Logger, a.Cfg, cachemetric)
 
+	go workers.SafetyRechecker(ctx, a.DB, a.Cache, a.Logger, a.Cfg, a.Recheck)
+
 	go a.Producer.Write(ctx, a.Logger)
 
 	consumers := make([]*kafka.KafkaConsumer, 6)
@@ -145,9 +151,15 @@ func (a *App) Init() {
 
 	a.Logger.Info("Inital cleanup finished")
 
+	err = a.InitSafety()
+
+	if err != nil {
+		a.Logger.Fatal("Safety checker initialization failed:", err)
+	}
+
 	a.Producer = kafka.NewProducer(a.Cfg)
 
-	router := base.SetupRoutes(a.DB, a.Cache, a.Logger, a.Producer, a.Cfg)
+	router := base.SetupRoutes(a.DB, a.Cache, a.Logger, a.Producer, a.Safety, a.Cfg)
 
 	a.Logger.Info("Routes are set")
 
@@ -188,6 +200,55 @@ func (a *App) InitStorage() error {
 	return nil
 }
 
+// InitSafety builds the chain of checkers every destination has to pass. Shortener chains are only
+// resolved for new destinations, the periodic recheck sticks to the local checks.
+func (a *App) InitSafety() error {
+	if a.Cfg.Safety.RecheckBatch < 1 || a.Cfg.Safety.RecheckBudget <= 0 {
+		return errors.New("Safety re-check batch and budget must be positive")
+	}
+
+	// The base url is accepted as is, only its host counts
+	ownDomains := append([]string{a.Cfg.Server.BaseUrl}, a.Cfg.Server.AliasDomains...)
+
+	registered := func(ctx context.Context, host string) (bool, error) {
+		dbCtx, dbCancel := context.WithTimeout(ctx, a.Cfg.DB.Timeout)
+		defer dbCancel()
+
+		_, err := a.DB.GetDomainOwner(dbCtx, host)
+
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	chain := safety.Chain{safety.NewLoopChecker(ownDomains, registered)}
+
+	// The recheck asks about the same few hosts over and over, one lookup per round is enough
+	recheck := safety.Chain{safety.NewLoopChecker(ownDomains, safety.RememberHosts(registered, a.Cfg.Safety.RecheckBudget))}
+
+	if a.Cfg.Safety.BlocklistPath != "" {
+		blocklist, err := safety.NewBlocklistChecker(a.Cfg.Safety.BlocklistPath, a.Cfg.Safety.BlocklistReload)
+
+		if err != nil {
+			return errors.New("Blocklist loading failed: " + err.Error())
+		}
+
+		chain = append(chain, blocklist)
+		recheck = append(recheck, blocklist)
+	}
+
+	a.Safety = chain
+	a.Recheck = recheck
+
+	if a.Cfg.Safety.ResolveDepth > 0 {
+		a.Safety = safety.NewShortenerResolver(chain, a.Cfg.Safety.Shorteners, a.Cfg.Safety.ResolveDepth, a.Cfg.Safety.ResolveTimeout, a.Cfg.Safety.ResolveBudget)
+	}
+
+	return nil
+}
+
 func (a *App) InitCleanUp() error {
 	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), a.Cfg.Cache.Timeout)
 	defer cacheCancel()
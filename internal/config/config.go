@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -17,6 +18,9 @@ type Config struct {
 	Kafka     KafkaConfig
 	Scheduler SchedulerConfig
 	Metrics   MetricsConfig
+	Auth      AuthConfig
+	Slug      SlugConfig
+	Safety    SafetyConfig
 }
 
 type ServerConfig struct {
@@ -25,15 +29,23 @@ type ServerConfig struct {
 	WriteTimeout    time.Duration
 	IdleTimeout     time.Duration
 	ShutdownTimeout time.Duration
+	CountryHeader   string
+	GeoDBPath       string
+	BotPatterns     []string
+	BulkMaxItems    int
+	BaseUrl         string
+	AliasDomains    []string
+	RedirectStatus  int
 }
 
 type DBConfig struct {
-	Host          string
-	User          string
-	Password      string
-	Name          string
-	Timeout       time.Duration
-	UrlExpiration time.Duration
+	Host             string
+	User             string
+	Password         string
+	Name             string
+	Timeout          time.Duration
+	UrlExpiration    time.Duration
+	MaxUrlExpiration time.Duration
 }
 
 type CacheConfig struct {
@@ -43,6 +55,7 @@ type CacheConfig struct {
 	Timeout       time.Duration
 	UrlExpiration time.Duration
 	IpExpiration  time.Duration
+	QrExpiration  time.Duration
 }
 
 type KafkaConfig struct {
@@ -61,10 +74,12 @@ type KafkaConfig struct {
 }
 
 type SchedulerConfig struct {
-	DBCleanupTimeout    time.Duration
-	DBFlushTimeout      time.Duration
-	CacheFlushTimeout   time.Duration
-	MetricsFlushTimeout time.Duration
+	DBCleanupTimeout     time.Duration
+	DBFlushTimeout       time.Duration
+	CacheFlushTimeout    time.Duration
+	MetricsFlushTimeout  time.Duration
+	VisitorsFlushTimeout time.Duration
+	SafetyRecheckTimeout time.Duration
 }
 
 type MetricsConfig struct {
@@ -72,6 +87,34 @@ type MetricsConfig struct {
 	StatsTimeout time.Duration
 }
 
+type AuthConfig struct {
+	AllowAnonymous bool
+	PasswordRPS    float64
+	PasswordBurst  float64
+	ContinueSecret string
+}
+
+type SlugConfig struct {
+	Strategy       string
+	Length         int
+	AliasMinLength int
+	AliasMaxLength int
+	Alphabet       string
+	Salt           string
+	MaxAttempts    int
+}
+
+type SafetyConfig struct {
+	BlocklistPath   string
+	BlocklistReload time.Duration
+	RecheckBatch    int
+	RecheckBudget   time.Duration
+	Shorteners      []string
+	ResolveDepth    int
+	ResolveTimeout  time.Duration
+	ResolveBudget   time.Duration
+}
+
 func Load() Config {
 	err := godotenv.Load()
 
@@ -79,21 +122,29 @@ func Load() Config {
 		log.Fatal("Failed to load .env: ", err)
 	}
 
-	return Config{
+	cfg := Config{
 		Server: ServerConfig{
 			Addr:            getString("ADDR"),
 			ReadTimeout:     getTime("READ_TIMEOUT"),
 			WriteTimeout:    getTime("WRITE_TIMEOUT"),
 			IdleTimeout:     getTime("IDLE_TIMEOUT"),
 			ShutdownTimeout: getTime("SHUTDOWN_TIMEOUT"),
+			CountryHeader:   os.Getenv("COUNTRY_HEADER"),
+			GeoDBPath:       os.Getenv("GEOIP_DB_PATH"),
+			BotPatterns:     getOptionalSliceString("BOT_UA_PATTERNS"),
+			BulkMaxItems:    getOptionalInt("BULK_MAX_ITEMS", 1000),
+			BaseUrl:         os.Getenv("BASE_URL"),
+			AliasDomains:    getOptionalSliceString("ALIAS_DOMAINS"),
+			RedirectStatus:  getOptionalInt("REDIRECT_STATUS", 308),
 		},
 		DB: DBConfig{
-			Host:          getString("DB_HOST"),
-			User:          getString("DB_USER"),
-			Password:      getString("DB_PASSWORD"),
-			Name:          getString("DB_NAME"),
-			Timeout:       getTime("DB_TIMEOUT"),
-			UrlExpiration: getTime("DB_URL_EXPIRATION"),
+			Host:             getString("DB_HOST"),
+			User:             getString("DB_USER"),
+			Password:         getString("DB_PASSWORD"),
+			Name:             getString("DB_NAME"),
+			Timeout:          getTime("DB_TIMEOUT"),
+			UrlExpiration:    getTime("DB_URL_EXPIRATION"),
+			MaxUrlExpiration: getOptionalTime("DB_URL_MAX_EXPIRATION", 5*365*24*time.Hour),
 		},
 		Cache: CacheConfig{
 			Host:          getString("CACHE_HOST"),
@@ -102,6 +153,7 @@ func Load() Config {
 			Timeout:       getTime("CACHE_TIMEOUT"),
 			UrlExpiration: getTime("CACHE_URL_EXPIRATION"),
 			IpExpiration:  getTime("CACHE_IP_EXPIRATION"),
+			QrExpiration:  getOptionalTime("CACHE_QR_EXPIRATION", 24*time.Hour),
 		},
 		Kafka: KafkaConfig{
 			Brokers:             getSliceString("KAFKA_BROKERS"),
@@ -118,16 +170,65 @@ func Load() Config {
 			CommitBatchTimeout:  getTime("KAFKA_COMMIT_BATCH_TIMEOUT"),
 		},
 		Scheduler: SchedulerConfig{
-			DBCleanupTimeout:    getTime("SCHEDULER_DB_CLEANUP_TIMEOUT"),
-			DBFlushTimeout:      getTime("SCHEDULER_DB_FLUSH_TIMEOUT"),
-			CacheFlushTimeout:   getTime("SCHEDULER_CACHE_FLUSH_TIMEOUT"),
-			MetricsFlushTimeout: getTime("SCHEDULER_METRICS_FLUSH_TIMEOUT"),
+			DBCleanupTimeout:     getTime("SCHEDULER_DB_CLEANUP_TIMEOUT"),
+			DBFlushTimeout:       getTime("SCHEDULER_DB_FLUSH_TIMEOUT"),
+			CacheFlushTimeout:    getTime("SCHEDULER_CACHE_FLUSH_TIMEOUT"),
+			MetricsFlushTimeout:  getTime("SCHEDULER_METRICS_FLUSH_TIMEOUT"),
+			VisitorsFlushTimeout: getOptionalTime("SCHEDULER_VISITORS_FLUSH_TIMEOUT", 0),
+			SafetyRecheckTimeout: getOptionalTime("SCHEDULER_SAFETY_RECHECK_TIMEOUT", time.Hour),
 		},
 		Metrics: MetricsConfig{
 			Addr:         getString("METRICS_ADDR"),
 			StatsTimeout: getTime("METRICS_STATS_TIMEOUT"),
 		},
+		Auth: AuthConfig{
+			AllowAnonymous: getOptionalBool("AUTH_ALLOW_ANONYMOUS", true),
+			PasswordRPS:    getOptionalFloat("AUTH_PASSWORD_RPS", 1),
+			PasswordBurst:  getOptionalFloat("AUTH_PASSWORD_BURST", 5),
+			ContinueSecret: os.Getenv("AUTH_CONTINUE_SECRET"),
+		},
+		Slug: SlugConfig{
+			Strategy:       getOptionalString("SLUG_STRATEGY", "random"),
+			Length:         getOptionalInt("SLUG_LENGTH", 7),
+			AliasMinLength: getOptionalInt("SLUG_ALIAS_MIN_LENGTH", 3),
+			AliasMaxLength: getOptionalInt("SLUG_ALIAS_MAX_LENGTH", 32),
+			Alphabet:       getOptionalString("SLUG_ALPHABET", "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"),
+			Salt:           os.Getenv("SLUG_SALT"),
+			MaxAttempts:    getOptionalInt("SLUG_MAX_ATTEMPTS", 5),
+		},
+		Safety: SafetyConfig{
+			BlocklistPath:   os.Getenv("SAFETY_BLOCKLIST_PATH"),
+			BlocklistReload: getOptionalTime("SAFETY_BLOCKLIST_RELOAD", 5*time.Minute),
+			RecheckBatch:    getOptionalInt("SAFETY_RECHECK_BATCH", 500),
+			RecheckBudget:   getOptionalTime("SAFETY_RECHECK_BUDGET", time.Minute),
+			Shorteners:      getOptionalSliceString("SAFETY_SHORTENER_DOMAINS"),
+			ResolveDepth:    getOptionalInt("SAFETY_RESOLVE_DEPTH", 0),
+			ResolveTimeout:  getOptionalTime("SAFETY_RESOLVE_TIMEOUT", 2*time.Second),
+			ResolveBudget:   getOptionalTime("SAFETY_RESOLVE_BUDGET", 5*time.Second),
+		},
+	}
+
+	if cfg.DB.UrlExpiration > cfg.DB.MaxUrlExpiration {
+		log.Fatal("Failed to load .env: DB_URL_EXPIRATION exceeds DB_URL_MAX_EXPIRATION")
 	}
+
+	// Visitor counts are flushed along with the clicks unless configured otherwise
+	if cfg.Scheduler.VisitorsFlushTimeout == 0 {
+		cfg.Scheduler.VisitorsFlushTimeout = cfg.Scheduler.DBFlushTimeout
+	}
+
+	// Short urls point at this instance unless a public base url is configured
+	if cfg.Server.BaseUrl == "" {
+		_, port, err := net.SplitHostPort(cfg.Server.Addr)
+
+		if err != nil || port == "" {
+			port = "8080"
+		}
+
+		cfg.Server.BaseUrl = "http://localhost:" + port
+	}
+
+	return cfg
 }
 
 func getString(key string) string {
@@ -140,6 +241,16 @@ func getString(key string) string {
 	return val
 }
 
+func getOptionalString(key string, def string) string {
+	val := os.Getenv(key)
+
+	if val == "" {
+		return def
+	}
+
+	return val
+}
+
 func getInt(key string) int {
 	val := os.Getenv(key)
 
@@ -172,6 +283,54 @@ func getFloat(key string) float64 {
 	return num
 }
 
+func getOptionalFloat(key string, def float64) float64 {
+	val := os.Getenv(key)
+
+	if val == "" {
+		return def
+	}
+
+	num, err := strconv.ParseFloat(val, 64)
+
+	if err != nil {
+		log.Fatal("Failed to load .env: ", err)
+	}
+
+	return num
+}
+
+func getOptionalInt(key string, def int) int {
+	val := os.Getenv(key)
+
+	if val == "" {
+		return def
+	}
+
+	num, err := strconv.Atoi(val)
+
+	if err != nil {
+		log.Fatal("Failed to load .env: ", err)
+	}
+
+	return num
+}
+
+func getOptionalBool(key string, def bool) bool {
+	val := os.Getenv(key)
+
+	if val == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(val)
+
+	if err != nil {
+		log.Fatal("Failed to load .env: ", err)
+	}
+
+	return b
+}
+
 func getTime(key string) time.Duration {
 	val := os.Getenv(key)
 
@@ -188,6 +347,22 @@ func getTime(key string) time.Duration {
 	return duration
 }
 
+func getOptionalTime(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+
+	if val == "" {
+		return def
+	}
+
+	duration, err := time.ParseDuration(val)
+
+	if err != nil {
+		log.Fatal("Failed to load .env: ", err)
+	}
+
+	return duration
+}
+
 func getSliceString(key string) []string {
 	val := os.Getenv(key)
 
@@ -199,3 +374,13 @@ func getSliceString(key string) []string {
 
 	return elems
 }
+
+func getOptionalSliceString(key string) []string {
+	val := os.Getenv(key)
+
+	if val == "" {
+		return nil
+	}
+
+	return strings.Split(val, ",")
+}
@@ -3,15 +3,18 @@ package base
 import (
 	"net/http"
 	"url-shortener/internal/config"
+	"url-shortener/internal/http/handlers/domains"
+	"url-shortener/internal/http/handlers/links"
 	"url-shortener/internal/http/handlers/url"
 	"url-shortener/internal/kafka"
 	"url-shortener/internal/logger"
+	"url-shortener/internal/safety"
 	"url-shortener/internal/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(db storage.Database, cache storage.Cache, logger logger.Logger, producer *kafka.KafkaProducer, cfg *config.Config) *gin.Engine {
+func SetupRoutes(db storage.Database, cache storage.Cache, logger logger.Logger, producer *kafka.KafkaProducer, checker safety.SafetyChecker, cfg *config.Config) *gin.Engine {
 	r := gin.New()
 
 	r.Use(gin.Recovery())
@@ -20,7 +23,11 @@ func SetupRoutes(db storage.Database, cache storage.Cache, logger logger.Logger,
 		c.JSON(http.StatusOK, "pong")
 	})
 
-	url.AddUrlRoutes(r, db, cache, logger, producer, cfg)
+	url.AddUrlRoutes(r, db, cache, logger, producer, checker, cfg)
+
+	links.AddLinksRoutes(r, db, cache, logger, checker, cfg)
+
+	domains.AddDomainsRoutes(r, db, logger, cfg)
 
 	return r
 }
@@ -0,0 +1,296 @@
+package domains
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+	"url-shortener/internal/config"
+	"url-shortener/internal/logger"
+	"url-shortener/internal/metrics"
+	"url-shortener/internal/middleware/auth"
+	"url-shortener/internal/middleware/ratelimiter"
+	"url-shortener/internal/middleware/requests"
+	"url-shortener/internal/models"
+	"url-shortener/internal/storage"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dnsTimeout bounds the TXT lookup of a verification
+const dnsTimeout = 5 * time.Second
+
+type DomainsHandler struct {
+	Cfg     *config.Config
+	Logger  logger.Logger
+	DB      storage.Database
+	Domains *url_utils.Domains
+}
+
+func AddDomainsRoutes(r *gin.Engine, db storage.Database, logger logger.Logger, cfg *config.Config) {
+	d := DomainsHandler{
+		DB:     db,
+		Logger: logger,
+		Cfg:    cfg,
+	}
+
+	domains, err := url_utils.NewDomains(cfg.Server)
+
+	if err != nil {
+		logger.Fatal("Base url error:", err)
+	}
+
+	d.Domains = domains
+
+	createMetric, _ := metrics.NewHttpMetric("domain_create")
+	listMetric, _ := metrics.NewHttpMetric("domain_list")
+	deleteMetric, _ := metrics.NewHttpMetric("domain_delete")
+	verifyMetric, _ := metrics.NewHttpMetric("domain_verify")
+
+	r.POST("/api/domains", requests.LoggingMiddleware(d.Logger, *createMetric), ratelimiter.RateLimiter(10, 10), auth.Authenticate(db, logger, cfg, true), d.CreateHandler)
+	r.GET("/api/domains", requests.LoggingMiddleware(d.Logger, *listMetric), ratelimiter.RateLimiter(100, 100), auth.Authenticate(db, logger, cfg, true), d.ListHandler)
+	r.POST("/api/domains/:host/verify", requests.LoggingMiddleware(d.Logger, *verifyMetric), ratelimiter.RateLimiter(10, 10), auth.Authenticate(db, logger, cfg, true), d.VerifyHandler)
+	r.DELETE("/api/domains/:host", requests.LoggingMiddleware(d.Logger, *deleteMetric), ratelimiter.RateLimiter(10, 10), auth.Authenticate(db, logger, cfg, true), d.DeleteHandler)
+}
+
+// CreateHandler registers a branded domain for the owner. The owner publishes the returned TXT
+// record and points the domain's DNS at the shortener. Once VerifyHandler found the record, links
+// can be created on it and are served when requests arrive with it as Host.
+func (d *DomainsHandler) CreateHandler(c *gin.Context) {
+	ownerID, _ := auth.OwnerID(c)
+
+	var req struct {
+		Host string `json:"host"`
+	}
+
+	err := c.BindJSON(&req)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	host := url_utils.NormalizeHost(req.Host)
+
+	err = url_utils.ValidateDomain(host)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "validation fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if d.Domains.IsDefault(host) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "validation fail",
+			"error":   "domain is already served as the default domain",
+		})
+		return
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), d.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	domain, err := d.DB.CreateDomain(dbCtx, ownerID, host)
+	dbCancel()
+
+	if errors.Is(err, storage.ErrDomainExists) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "domain taken",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		d.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "store fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "successfully registered, publish the TXT record to verify",
+		"domain":  withVerification(domain),
+	})
+
+	d.Logger.Info("Domain registered", host, ownerID)
+}
+
+func (d *DomainsHandler) ListHandler(c *gin.Context) {
+	ownerID, _ := auth.OwnerID(c)
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), d.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	domains, err := d.DB.ListDomains(dbCtx, ownerID)
+	dbCancel()
+
+	if err != nil {
+		d.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "list fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	for i := range domains {
+		domains[i] = withVerification(domains[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"domains": domains,
+	})
+}
+
+// VerifyHandler looks up the domain's TXT record and activates the domain when it holds the token.
+// Until then the domain can't be used for links and doesn't count as one of the shortener's own.
+func (d *DomainsHandler) VerifyHandler(c *gin.Context) {
+	ownerID, _ := auth.OwnerID(c)
+
+	host := url_utils.NormalizeHost(c.Param("host"))
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), d.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	domain, err := d.DB.GetDomain(dbCtx, ownerID, host)
+	dbCancel()
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return
+	}
+
+	if err != nil {
+		d.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "lookup fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if domain.VerifiedAt != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "already verified",
+			"domain":  domain,
+		})
+		return
+	}
+
+	dnsCtx, dnsCancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer dnsCancel()
+
+	records, err := net.DefaultResolver.LookupTXT(dnsCtx, url_utils.VerifyRecord(host))
+	dnsCancel()
+
+	var dnsErr *net.DNSError
+
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		d.Logger.Warn("TXT lookup error:", host, err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"message": "lookup fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if !slices.Contains(records, url_utils.VerifyValue(domain.VerifyToken)) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "verification fail",
+			"error":   "no TXT record " + url_utils.VerifyRecord(host) + " with the verification value found",
+			"domain":  withVerification(domain),
+		})
+		return
+	}
+
+	dbCtx, dbCancel = context.WithTimeout(context.Background(), d.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	err = d.DB.VerifyDomain(dbCtx, ownerID, host)
+	dbCancel()
+
+	if err != nil {
+		d.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "store fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	domain.VerifiedAt = &now
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "successfully verified",
+		"domain":  domain,
+	})
+
+	d.Logger.Info("Domain verified", host, ownerID)
+}
+
+// withVerification fills in the TXT record a domain still waiting for verification needs
+func withVerification(domain models.Domain) models.Domain {
+	if domain.VerifiedAt == nil {
+		domain.VerifyRecord = url_utils.VerifyRecord(domain.Host)
+		domain.VerifyValue = url_utils.VerifyValue(domain.VerifyToken)
+	}
+
+	return domain
+}
+
+// DeleteHandler only removes domains without links, another owner's domain looks like a missing one
+func (d *DomainsHandler) DeleteHandler(c *gin.Context) {
+	ownerID, _ := auth.OwnerID(c)
+
+	host := url_utils.NormalizeHost(c.Param("host"))
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), d.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	err := d.DB.DeleteDomain(dbCtx, ownerID, host)
+	dbCancel()
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return
+	}
+
+	if errors.Is(err, storage.ErrDomainInUse) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "domain in use",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		d.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "delete fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+
+	d.Logger.Info("Domain deleted", host, ownerID)
+}
@@ -0,0 +1,128 @@
+package links
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"url-shortener/internal/middleware/auth"
+	"url-shortener/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var exportHeader = []string{"slug", "domain", "long_url", "clicks", "created_at", "expires_at"}
+
+type exportRow struct {
+	Slug       string     `json:"slug"`
+	Domain     string     `json:"domain,omitempty"`
+	LongUrl    string     `json:"long_url"`
+	Clicks     int64      `json:"clicks"`
+	Created_at time.Time  `json:"created_at"`
+	Expires_at *time.Time `json:"expires_at"`
+}
+
+// ExportHandler streams every link of the owner as CSV or JSON lines straight from the database cursor.
+// Once the first row is out the status can't change anymore, so a failure halfway just cuts the stream.
+func (l *LinksHandler) ExportHandler(c *gin.Context) {
+	ownerID, _ := auth.OwnerID(c)
+
+	format := c.DefaultQuery("format", "csv")
+
+	var write func(models.Url) error
+	var flush func() error
+
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(c.Writer)
+
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+
+		// Buffered by the csv writer until the first flush, after the status is set
+		writer.Write(exportHeader)
+
+		write = func(url models.Url) error {
+			expiresAt := ""
+
+			if url.Expires_at != nil {
+				expiresAt = url.Expires_at.UTC().Format(time.RFC3339)
+			}
+
+			return writer.Write([]string{
+				url.Slug,
+				url.Domain,
+				url.LongUrl,
+				strconv.FormatInt(url.Clicks, 10),
+				url.Created_at.UTC().Format(time.RFC3339),
+				expiresAt,
+			})
+		}
+
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case "jsonl":
+		encoder := json.NewEncoder(c.Writer)
+
+		c.Header("Content-Type", "application/x-ndjson")
+
+		write = func(url models.Url) error {
+			return encoder.Encode(exportRow{
+				Slug:       url.Slug,
+				Domain:     url.Domain,
+				LongUrl:    url.LongUrl,
+				Clicks:     url.Clicks,
+				Created_at: url.Created_at,
+				Expires_at: url.Expires_at,
+			})
+		}
+
+		flush = func() error {
+			return nil
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "format must be csv or jsonl",
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="links.`+format+`"`)
+	c.Status(http.StatusOK)
+
+	exported := 0
+
+	// The request context stops the query as soon as the client goes away
+	err := l.DB.ExportUrls(c.Request.Context(), ownerID, func(url models.Url) error {
+		err := write(url)
+
+		if err != nil {
+			return err
+		}
+
+		exported++
+
+		if exported%1000 == 0 {
+			err = flush()
+			c.Writer.Flush()
+		}
+
+		return err
+	})
+
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		l.Logger.Error("Export error:", ownerID, exported, err)
+		return
+	}
+
+	c.Writer.Flush()
+
+	l.Logger.Info("Links exported", ownerID, exported)
+}
@@ -0,0 +1,342 @@
+package links
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"url-shortener/internal/config"
+	"url-shortener/internal/logger"
+	"url-shortener/internal/metrics"
+	"url-shortener/internal/middleware/auth"
+	"url-shortener/internal/middleware/ratelimiter"
+	"url-shortener/internal/middleware/requests"
+	"url-shortener/internal/models"
+	"url-shortener/internal/safety"
+	"url-shortener/internal/storage"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LinksHandler struct {
+	Cfg     *config.Config
+	Logger  logger.Logger
+	DB      storage.Database
+	Cache   storage.Cache
+	Safety  safety.SafetyChecker
+	Domains *url_utils.Domains
+}
+
+func AddLinksRoutes(r *gin.Engine, db storage.Database, cache storage.Cache, logger logger.Logger, checker safety.SafetyChecker, cfg *config.Config) {
+	l := LinksHandler{
+		DB:     db,
+		Cache:  cache,
+		Logger: logger,
+		Cfg:    cfg,
+		Safety: checker,
+	}
+
+	domains, err := url_utils.NewDomains(cfg.Server)
+
+	if err != nil {
+		logger.Fatal("Base url error:", err)
+	}
+
+	l.Domains = domains
+
+	listMetric, _ := metrics.NewHttpMetric("list")
+	exportMetric, _ := metrics.NewHttpMetric("export")
+	updateMetric, _ := metrics.NewHttpMetric("update")
+	deleteMetric, _ := metrics.NewHttpMetric("delete")
+	statsMetric, _ := metrics.NewHttpMetric("stats")
+	timeseriesMetric, _ := metrics.NewHttpMetric("timeseries")
+	breakdownMetric, _ := metrics.NewHttpMetric("breakdown")
+
+	r.GET("/api/links", requests.LoggingMiddleware(l.Logger, *listMetric), ratelimiter.RateLimiter(100, 100), auth.Authenticate(db, logger, cfg, true), l.ListHandler)
+	r.GET("/api/links/export", requests.LoggingMiddleware(l.Logger, *exportMetric), ratelimiter.RateLimiter(1, 5), auth.Authenticate(db, logger, cfg, true), l.ExportHandler)
+	r.PATCH("/api/links/:slug", requests.LoggingMiddleware(l.Logger, *updateMetric), ratelimiter.RateLimiter(100, 100), auth.Authenticate(db, logger, cfg, true), l.UpdateHandler)
+	r.DELETE("/api/links/:slug", requests.LoggingMiddleware(l.Logger, *deleteMetric), ratelimiter.RateLimiter(100, 100), auth.Authenticate(db, logger, cfg, true), l.DeleteHandler)
+	r.GET("/api/links/:slug/stats", requests.LoggingMiddleware(l.Logger, *statsMetric), ratelimiter.RateLimiter(1000, 100), auth.Authenticate(db, logger, cfg, false), l.StatsHandler)
+	r.GET("/api/links/:slug/timeseries", requests.LoggingMiddleware(l.Logger, *timeseriesMetric), ratelimiter.RateLimiter(1000, 100), auth.Authenticate(db, logger, cfg, false), l.TimeseriesHandler)
+	r.GET("/api/links/:slug/breakdown", requests.LoggingMiddleware(l.Logger, *breakdownMetric), ratelimiter.RateLimiter(1000, 100), auth.Authenticate(db, logger, cfg, false), l.BreakdownHandler)
+}
+
+func (l *LinksHandler) StatsHandler(c *gin.Context) {
+	key, ok := l.authorize(c, c.Param("slug"), false)
+
+	if !ok {
+		return
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	stats, err := l.DB.GetStats(dbCtx, key)
+	dbCancel()
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return
+	}
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "stats fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// Clicks still sitting in the redis hashes have not been flushed by the scheduler yet
+	stats.PendingClicks, err = l.pendingCount("clicks", key)
+
+	if err != nil {
+		l.Logger.Error("Cache error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "stats fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	pendingBots, err := l.pendingCount("bot_clicks", key)
+
+	if err != nil {
+		l.Logger.Error("Cache error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "stats fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	stats.BotClicks += pendingBots
+
+	// The persisted value lags behind the live sketch until the scheduler flushes it
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), l.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	visitors, err := l.Cache.CountVisitors(cacheCtx, key)
+	cacheCancel()
+
+	if err != nil {
+		l.Logger.Error("Cache error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "stats fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	stats.UniqueVisitors = max(stats.UniqueVisitors, visitors[key])
+	stats.TotalClicks = stats.Clicks + stats.PendingClicks
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// authorize writes the error response itself and reports whether the request may go on.
+// Links without an owner stay publicly readable, but only an owner can modify a link.
+// Links on a branded domain are addressed with ?domain=, the link key is returned.
+func (l *LinksHandler) authorize(c *gin.Context, slug string, modify bool) (string, bool) {
+	err := url_utils.ValidateSlug(slug, l.Cfg.Slug)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return "", false
+	}
+
+	key := url_utils.LinkKey(l.Domains.Resolve(c.Query("domain")), slug)
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	owner, err := l.DB.GetUrlOwner(dbCtx, key)
+	dbCancel()
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return "", false
+	}
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "lookup fail",
+			"error":   err.Error(),
+		})
+		return "", false
+	}
+
+	if owner == nil && !modify {
+		return key, true
+	}
+
+	ownerID, ok := auth.OwnerID(c)
+
+	if owner == nil || !ok || ownerID != *owner {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "forbidden",
+		})
+		return "", false
+	}
+
+	return key, true
+}
+
+// pendingCount includes the counts of a flush in progress, so they are never missing from the stats
+// while the scheduler moves them to postgres
+func (l *LinksHandler) pendingCount(hash string, key string) (int64, error) {
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), l.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	pending, err := l.Cache.PendingCount(cacheCtx, hash, key)
+
+	return pending, err
+}
+
+func (l *LinksHandler) TimeseriesHandler(c *gin.Context) {
+	slug := c.Param("slug")
+
+	var err error
+
+	granularity := c.DefaultQuery("granularity", "hour")
+
+	if granularity != "hour" && granularity != "day" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "granularity must be hour or day",
+		})
+		return
+	}
+
+	to := time.Now().UTC()
+
+	if raw := c.Query("to"); raw != "" {
+		to, err = time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "bad request",
+				"error":   "invalid to: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	from := to.Add(-24 * time.Hour)
+
+	if granularity == "day" {
+		from = to.AddDate(0, 0, -30)
+	}
+
+	if raw := c.Query("from"); raw != "" {
+		from, err = time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "bad request",
+				"error":   "invalid from: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "from must be before to",
+		})
+		return
+	}
+
+	key, ok := l.authorize(c, slug, false)
+
+	if !ok {
+		return
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	points, err := l.DB.GetClicksTimeseries(dbCtx, key, granularity, from, to)
+	dbCancel()
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "timeseries fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"slug":        slug,
+		"granularity": granularity,
+		"from":        from,
+		"to":          to,
+		"points":      points,
+	})
+}
+
+func (l *LinksHandler) BreakdownHandler(c *gin.Context) {
+	slug := c.Param("slug")
+
+	dimension := c.Query("dimension")
+
+	if !slices.Contains(models.BreakdownDimensions, dimension) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "dimension must be one of " + strings.Join(models.BreakdownDimensions, ", "),
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "limit must be between 1 and 100",
+		})
+		return
+	}
+
+	key, ok := l.authorize(c, slug, false)
+
+	if !ok {
+		return
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	entries, err := l.DB.GetBreakdown(dbCtx, key, dimension, limit)
+	dbCancel()
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "breakdown fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"slug":      slug,
+		"dimension": dimension,
+		"entries":   entries,
+	})
+}
@@ -0,0 +1,301 @@
+package links
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+	"url-shortener/internal/middleware/auth"
+	"url-shortener/internal/models"
+	"url-shortener/internal/safety"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (l *LinksHandler) ListHandler(c *gin.Context) {
+	ownerID, _ := auth.OwnerID(c)
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "page must be a positive number",
+		})
+		return
+	}
+
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+
+	if err != nil || perPage < 1 || perPage > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "per_page must be between 1 and 100",
+		})
+		return
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	// One extra row tells whether there is a next page without counting everything
+	urls, err := l.DB.ListUrls(dbCtx, ownerID, perPage+1, (page-1)*perPage)
+	dbCancel()
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "list fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	hasMore := len(urls) > perPage
+
+	if hasMore {
+		urls = urls[:perPage]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"links":    urls,
+		"page":     page,
+		"per_page": perPage,
+		"has_more": hasMore,
+	})
+}
+
+func (l *LinksHandler) UpdateHandler(c *gin.Context) {
+	// Authorized first, the checks below fetch the new destinations
+	key, ok := l.authorize(c, c.Param("slug"), true)
+
+	if !ok {
+		return
+	}
+
+	var update models.UrlUpdate
+
+	err := c.BindJSON(&update)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	expiryChanged := update.Expires_at != nil || update.TTL != nil || update.Permanent
+
+	if update.LongUrl == nil && update.Title == nil && update.Interstitial == nil && update.ForwardQuery == nil && update.Rules == nil && !expiryChanged {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   "nothing to update",
+		})
+		return
+	}
+
+	if update.Title != nil && utf8.RuneCountInString(*update.Title) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "validation fail",
+			"error":   "title can't be longer than 255 characters",
+		})
+		return
+	}
+
+	safetyCtx := safety.WithResolveBudget(c.Request.Context(), l.Cfg.Safety.ResolveBudget)
+
+	if update.LongUrl != nil {
+		err = url_utils.ValidateUrl(*update.LongUrl)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "validation fail",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		canonicalUrl, err := url_utils.CanonicalizeUrl(*update.LongUrl)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "validation fail",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		hash := url_utils.HashUrl(canonicalUrl)
+		update.LongUrlHash = &hash
+
+		// A new destination has to pass the same checks as on create, passing them lifts a previous disable
+		reason, err := l.Safety.Check(safetyCtx, *update.LongUrl)
+
+		if err != nil {
+			l.Logger.Error("Safety check error:", *update.LongUrl, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "safety check fail",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		if reason != "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "unsafe url",
+				"error":   reason,
+			})
+			return
+		}
+	}
+
+	if update.Rules != nil {
+		err = url_utils.NormalizeRules(*update.Rules)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "validation fail",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		reason, err := safety.CheckRules(safetyCtx, l.Safety, *update.Rules)
+
+		if err != nil {
+			l.Logger.Error("Safety check error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "safety check fail",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		if reason != "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "unsafe url",
+				"error":   reason,
+			})
+			return
+		}
+	}
+
+	if expiryChanged {
+		ttl := ""
+
+		if update.TTL != nil {
+			ttl = *update.TTL
+		}
+
+		update.Expires_at, err = url_utils.ResolveExpiration(time.Now(), update.Expires_at, ttl, update.Permanent, l.Cfg.DB.UrlExpiration, l.Cfg.DB.MaxUrlExpiration)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "validation fail",
+				"error":   err.Error(),
+			})
+			return
+		}
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	url, err := l.DB.UpdateUrl(dbCtx, key, update)
+	dbCancel()
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return
+	}
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "update fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if !l.invalidate(c, key, false) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "successfully updated",
+		"link":    url,
+	})
+
+	l.Logger.Info("Short url updated", key, url.LongUrl)
+}
+
+func (l *LinksHandler) DeleteHandler(c *gin.Context) {
+	key, ok := l.authorize(c, c.Param("slug"), true)
+
+	if !ok {
+		return
+	}
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), l.Cfg.DB.Timeout)
+	defer dbCancel()
+
+	err := l.DB.DeleteUrl(dbCtx, key)
+	dbCancel()
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not found",
+		})
+		return
+	}
+
+	if err != nil {
+		l.Logger.Error("Postgres error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "delete fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if !l.invalidate(c, key, true) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+
+	l.Logger.Info("Short url deleted", key)
+}
+
+// invalidate drops the cached target so the redirect handler never serves a stale one.
+// A failure is reported to the client, the change itself is already committed and safe to retry.
+func (l *LinksHandler) invalidate(c *gin.Context, key string, purge bool) bool {
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), l.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	var err error
+
+	if purge {
+		err = l.Cache.PurgeUrl(cacheCtx, key)
+	} else {
+		err = l.Cache.DeleteUrl(cacheCtx, key)
+	}
+
+	if err != nil {
+		l.Logger.Error("Cache invalidation error:", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "cache invalidation fail",
+			"error":   err.Error(),
+		})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,374 @@
+package url
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"url-shortener/internal/middleware/auth"
+	"url-shortener/internal/models"
+	"url-shortener/internal/safety"
+	"url-shortener/internal/storage"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+type bulkResult struct {
+	Index     int        `json:"index"`
+	LongUrl   string     `json:"long_url"`
+	Slug      string     `json:"slug,omitempty"`
+	Domain    string     `json:"domain,omitempty"`
+	ShortUrl  string     `json:"short_url,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// BulkHandler creates many links in one request from a JSON array or a CSV file.
+// Every item is validated on its own, a bad item fails alone and is reported in the results.
+func (u *UrlHandler) BulkHandler(c *gin.Context) {
+	// No item can be bigger than a long url plus its options
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(u.Cfg.Server.BulkMaxItems)*4096)
+
+	items, err := u.readBulkItems(c)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if len(items) == 0 || len(items) > u.Cfg.Server.BulkMaxItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   fmt.Sprintf("expected between 1 and %d items", u.Cfg.Server.BulkMaxItems),
+		})
+		return
+	}
+
+	var ownerID *int64
+
+	if id, ok := auth.OwnerID(c); ok {
+		ownerID = &id
+	}
+
+	now := time.Now()
+	results := make([]bulkResult, len(items))
+	aliases := make(map[string]bool)
+	domains := make(map[string]error)
+
+	// All items share one budget for resolving shortener chains
+	safetyCtx := safety.WithResolveBudget(c.Request.Context(), u.Cfg.Safety.ResolveBudget)
+
+	var pending []int
+
+	for i := range items {
+		results[i] = bulkResult{Index: i, LongUrl: items[i].LongUrl}
+
+		// Slugs come from the alias or the generator only, a client slug would skip ValidateSlug
+		items[i].Slug = ""
+
+		if items[i].Password != "" {
+			results[i].Error = "password protected links can't be created in bulk"
+			continue
+		}
+
+		err = u.prepareUrl(&items[i], ownerID, now)
+
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		domainErr, ok := domains[items[i].Domain]
+
+		if !ok {
+			domainErr = u.checkDomain(items[i].Domain, ownerID)
+			domains[items[i].Domain] = domainErr
+		}
+
+		if domainErr != nil {
+			results[i].Error = domainErr.Error()
+			continue
+		}
+
+		reason, err := u.Safety.Check(safetyCtx, items[i].LongUrl)
+
+		if err == nil && reason == "" {
+			reason, err = safety.CheckRules(safetyCtx, u.Safety, items[i].Rules)
+		}
+
+		if err != nil {
+			u.Logger.Error("Safety check error:", items[i].LongUrl, err)
+			results[i].Error = "safety check fail: " + err.Error()
+			continue
+		}
+
+		if reason != "" {
+			results[i].Error = "unsafe url: " + reason
+			continue
+		}
+
+		if alias := items[i].CustomAlias; alias != "" {
+			key := url_utils.LinkKey(items[i].Domain, alias)
+
+			if aliases[key] {
+				results[i].Error = "duplicate alias in request"
+				continue
+			}
+
+			aliases[key] = true
+			items[i].Slug = alias
+		}
+
+		pending = append(pending, i)
+	}
+
+	pending, err = u.storeBulk(items, pending, aliases, results)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "store fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	for _, i := range pending {
+		results[i].Error = ErrSlugAttempts.Error()
+	}
+
+	created := 0
+
+	for _, r := range results {
+		if r.Error == "" {
+			created++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"created": created,
+		"failed":  len(results) - created,
+		"results": results,
+	})
+
+	u.Logger.Info("Bulk short urls created", created, len(results))
+}
+
+// storeBulk inserts the pending items, regenerating slugs that collided for as many rounds as
+// single creation would retry. It returns the items that still could not be stored.
+// taken holds the link keys already claimed by the batch.
+func (u *UrlHandler) storeBulk(items []models.Url, pending []int, taken map[string]bool, results []bulkResult) ([]int, error) {
+	for attempt := 1; attempt <= u.Cfg.Slug.MaxAttempts && len(pending) > 0; attempt++ {
+		batch := make([]models.Url, 0, len(pending))
+
+		for _, i := range pending {
+			for items[i].CustomAlias == "" && items[i].Slug == "" {
+				slug, err := u.generateSlug()
+
+				if err != nil {
+					return nil, err
+				}
+
+				// Two items of one batch must not race for the same slug
+				if key := url_utils.LinkKey(items[i].Domain, slug); !taken[key] {
+					taken[key] = true
+					items[i].Slug = slug
+				}
+			}
+
+			batch = append(batch, items[i])
+		}
+
+		dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
+		stored, err := u.DB.StoreUrls(dbCtx, batch)
+		dbCancel()
+
+		if err != nil {
+			u.Logger.Error("Postgres error:", err)
+			return nil, err
+		}
+
+		var retry []int
+
+		for _, i := range pending {
+			slug := items[i].Slug
+
+			switch {
+			case stored[url_utils.LinkKey(items[i].Domain, slug)]:
+				results[i].Slug = slug
+				results[i].Domain = items[i].Domain
+				results[i].ShortUrl = u.shortUrl(items[i].Domain, slug)
+				results[i].ExpiresAt = items[i].Expires_at
+			case items[i].CustomAlias != "":
+				results[i].Error = storage.ErrSlugExists.Error()
+			default:
+				u.SlugMetric.Collisions.Inc()
+				items[i].Slug = ""
+				retry = append(retry, i)
+			}
+		}
+
+		pending = retry
+	}
+
+	return pending, nil
+}
+
+func (u *UrlHandler) readBulkItems(c *gin.Context) ([]models.Url, error) {
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+
+	switch contentType {
+	case "application/json":
+		var items []models.Url
+
+		err := c.ShouldBindJSON(&items)
+
+		return items, err
+	case "text/csv":
+		return u.readBulkCsv(c.Request.Body)
+	case "multipart/form-data":
+		header, err := c.FormFile("file")
+
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := header.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+
+		return u.readBulkCsv(file)
+	}
+
+	return nil, errors.New("content type must be application/json, text/csv or multipart/form-data")
+}
+
+// readBulkCsv expects a header row, long_url is required and alias, domain, ttl, expires_at,
+// permanent, max_clicks, redirect_status, forward_query and the utm_ parameters are optional
+// columns in any order
+func (u *UrlHandler) readBulkCsv(r io.Reader) ([]models.Url, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+
+	if err != nil {
+		return nil, errors.New("csv header: " + err.Error())
+	}
+
+	columns := make(map[string]int, len(header))
+
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	if _, ok := columns["long_url"]; !ok {
+		return nil, errors.New("csv header must have a long_url column")
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+
+		if !ok {
+			return ""
+		}
+
+		return strings.TrimSpace(record[i])
+	}
+
+	var items []models.Url
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(items) == u.Cfg.Server.BulkMaxItems {
+			return nil, fmt.Errorf("more than %d items", u.Cfg.Server.BulkMaxItems)
+		}
+
+		item := models.Url{
+			LongUrl:     field(record, "long_url"),
+			CustomAlias: field(record, "alias"),
+			Domain:      field(record, "domain"),
+			TTL:         field(record, "ttl"),
+		}
+
+		if raw := field(record, "expires_at"); raw != "" {
+			expiresAt, err := time.Parse(time.RFC3339, raw)
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid expires_at: %w", line, err)
+			}
+
+			item.Expires_at = &expiresAt
+		}
+
+		if raw := field(record, "permanent"); raw != "" {
+			item.Permanent, err = strconv.ParseBool(raw)
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid permanent: %w", line, err)
+			}
+		}
+
+		if raw := field(record, "max_clicks"); raw != "" {
+			item.MaxClicks, err = strconv.ParseInt(raw, 10, 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid max_clicks: %w", line, err)
+			}
+		}
+
+		if raw := field(record, "forward_query"); raw != "" {
+			item.ForwardQuery, err = strconv.ParseBool(raw)
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid forward_query: %w", line, err)
+			}
+		}
+
+		utm := models.Utm{
+			Source:   field(record, "utm_source"),
+			Medium:   field(record, "utm_medium"),
+			Campaign: field(record, "utm_campaign"),
+			Term:     field(record, "utm_term"),
+			Content:  field(record, "utm_content"),
+		}
+
+		if utm != (models.Utm{}) {
+			item.Utm = &utm
+		}
+
+		if raw := field(record, "redirect_status"); raw != "" {
+			item.RedirectStatus, err = strconv.Atoi(raw)
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid redirect_status: %w", line, err)
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,119 @@
+package url
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"time"
+	"url-shortener/internal/middleware/ratelimiter"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var passwordForm = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>Password required</title>
+</head>
+<body>
+	<h1>This link is password protected</h1>
+	{{if .Error}}<p style="color: #b00">{{.Error}}</p>{{end}}
+	<form method="POST" action="{{.Action}}">
+		<input type="password" name="password" placeholder="Password" autofocus required>
+		<button type="submit">Continue</button>
+	</form>
+</body>
+</html>
+`))
+
+func (u *UrlHandler) renderPasswordForm(c *gin.Context, slug string, status int, message string) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+
+	err := passwordForm.Execute(c.Writer, gin.H{
+		"Action": carryQuery(c, "/"+slug),
+		"Error":  message,
+	})
+
+	if err != nil {
+		u.Logger.Error("Template error:", err)
+	}
+}
+
+// UnlockHandler checks the password submitted through the form and redirects on success, links
+// with an interstitial show it first.
+// Attempts are limited per link rather than per address so spreading a guess over many IPs does not help.
+func (u *UrlHandler) UnlockHandler(c *gin.Context) {
+	slug := c.Param("slug")
+
+	err := url_utils.ValidateSlug(slug, u.Cfg.Slug)
+
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	domain := u.Domains.Resolve(c.Request.Host)
+	key := url_utils.LinkKey(domain, slug)
+
+	link, err := u.lookup(key)
+
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if link.Expires_at != nil && !link.Expires_at.After(time.Now()) {
+		c.Status(http.StatusGone)
+		return
+	}
+
+	if link.Disabled != "" {
+		u.renderWarning(c, key, link.Disabled)
+		return
+	}
+
+	if link.PasswordHash == "" {
+		c.Redirect(http.StatusSeeOther, carryQuery(c, "/"+slug))
+		return
+	}
+
+	allow, err := ratelimiter.Allow(u.Cache, "password:"+key, u.Cfg.Auth.PasswordRPS, u.Cfg.Auth.PasswordBurst, u.Cfg)
+
+	if err != nil {
+		u.Logger.Error("Cache error:", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if !allow {
+		u.renderPasswordForm(c, slug, http.StatusTooManyRequests, "Too many attempts, try again later")
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(c.PostForm("password")))
+
+	if err != nil {
+		u.Logger.Warn("Wrong link password", key)
+		u.renderPasswordForm(c, slug, http.StatusUnauthorized, "Wrong password")
+		return
+	}
+
+	if link.Interstitial {
+		u.renderPreview(c, domain, slug, link, true)
+		return
+	}
+
+	u.serve(c, key, link, http.StatusSeeOther)
+}
@@ -0,0 +1,74 @@
+package url
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"time"
+	"url-shortener/internal/models"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>{{if .Title}}{{.Title}}{{else}}Link preview{{end}}</title>
+</head>
+<body>
+	{{if .Leaving}}<h1>You are about to leave this site</h1>{{else}}<h1>Link preview</h1>{{end}}
+	{{if .Title}}<h2>{{.Title}}</h2>{{end}}
+	{{if .Destination}}<p>This link goes to <code>{{.Destination}}</code></p>{{else}}<p>The destination of this link is only revealed when it is opened, it can be opened {{.MaxClicks}} time(s) in total.</p>{{end}}
+	<p><a href="{{.Continue}}">Continue</a></p>
+	{{if .Qr}}<img src="{{.Qr}}" alt="QR code for {{.ShortUrl}}" width="256" height="256">{{end}}
+	<p><small>{{.ShortUrl}}</small></p>
+</body>
+</html>
+`))
+
+// renderPreview shows where a link goes instead of redirecting. It serves both the preview requested
+// by the visitor and the interstitial forced by the owner, neither counts as a click.
+func (u *UrlHandler) renderPreview(c *gin.Context, domain string, slug string, link models.UrlRecord, leaving bool) {
+	shortUrl := u.shortUrl(domain, slug)
+
+	// Continuing keeps the rest of the query, preview only applies to this page
+	query := c.Request.URL.Query()
+	query.Del("preview")
+	query.Set("go", u.Continue.Issue(url_utils.LinkKey(domain, slug), time.Now()))
+
+	data := gin.H{
+		"Title":       link.Title,
+		"Leaving":     leaving,
+		"Destination": u.destination(c, link),
+		"MaxClicks":   link.MaxClicks,
+		"Continue":    "/" + slug + "?" + query.Encode(),
+		"ShortUrl":    shortUrl,
+	}
+
+	// Showing the target would let anyone use a click-limited link without spending a click
+	if link.MaxClicks > 0 {
+		data["Destination"] = ""
+	}
+
+	png, err := u.qrCode(shortUrl+"?src="+sourceQr, url_utils.DefaultQrOptions())
+
+	if err != nil {
+		u.Logger.Warn("QR code generation error, previewing without it:", slug, err)
+	} else {
+		data["Qr"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	err = previewPage.Execute(c.Writer, data)
+
+	if err != nil {
+		u.Logger.Error("Template error:", err)
+	}
+}
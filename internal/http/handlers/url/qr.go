@@ -0,0 +1,162 @@
+package url
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"url-shortener/internal/utils/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// QrCodeHandler renders the short url of an existing link as a QR code, size, level, fg, bg, border
+// and format query parameters override the defaults. The encoded url carries src=qr so scans can be
+// told apart from other clicks.
+func (u *UrlHandler) QrCodeHandler(c *gin.Context) {
+	slug := c.Param("slug")
+
+	opts, err := qrOptions(c)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "bad request",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	err = url_utils.ValidateSlug(slug, u.Cfg.Slug)
+
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	domain := u.Domains.Resolve(c.Request.Host)
+
+	link, err := u.lookup(url_utils.LinkKey(domain, slug))
+
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if link.Expires_at != nil && !link.Expires_at.After(time.Now()) {
+		c.Status(http.StatusGone)
+		return
+	}
+
+	if link.Disabled != "" {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	content := u.shortUrl(domain, slug) + "?src=" + sourceQr
+
+	// The image only depends on what is encoded and how, so the cache key doubles as the ETag.
+	// CDNs may keep it until the link expires at the latest.
+	etag := `"` + opts.CacheKey(content) + `"`
+	maxAge := int(u.cacheTTL(link, u.Cfg.Cache.QrExpiration).Seconds())
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(max(maxAge, 0)))
+
+	// A list of tags or a weak match still contains the quoted hash
+	if strings.Contains(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	data, err := u.qrCode(content, opts)
+
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		u.Logger.Error("QR code generation error:", err)
+		return
+	}
+
+	c.Data(http.StatusOK, opts.ContentType(), data)
+}
+
+func qrOptions(c *gin.Context) (url_utils.QrOptions, error) {
+	opts := url_utils.DefaultQrOptions()
+
+	var err error
+
+	if raw := c.Query("size"); raw != "" {
+		opts.Size, err = strconv.Atoi(raw)
+
+		if err != nil {
+			return opts, errors.New("size must be a number")
+		}
+	}
+
+	if raw := c.Query("border"); raw != "" {
+		opts.Border, err = strconv.Atoi(raw)
+
+		if err != nil {
+			return opts, errors.New("border must be a number")
+		}
+	}
+
+	opts.Level = c.DefaultQuery("level", opts.Level)
+	opts.Foreground = c.DefaultQuery("fg", opts.Foreground)
+	opts.Background = c.DefaultQuery("bg", opts.Background)
+	opts.Format = c.DefaultQuery("format", opts.Format)
+
+	opts.Normalize()
+
+	return opts, opts.Validate()
+}
+
+// qrCode serves common renderings from redis and only encodes on a miss, others are rendered every
+// time. The cache is an optimization, when redis fails the code is rendered anyway.
+func (u *UrlHandler) qrCode(content string, opts url_utils.QrOptions) ([]byte, error) {
+	if !opts.Cacheable() {
+		return url_utils.GenerateQrCode(content, opts)
+	}
+
+	key := opts.CacheKey(content)
+
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), u.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	data, err := u.Cache.GetQrCode(cacheCtx, key)
+	cacheCancel()
+
+	if err == nil {
+		return data, nil
+	}
+
+	if err != redis.Nil {
+		u.Logger.Warn("Cache error, rendering QR code anyway:", err)
+	}
+
+	data, err = url_utils.GenerateQrCode(content, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cacheCtx, cacheCancel = context.WithTimeout(context.Background(), u.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	err = u.Cache.StoreQrCode(cacheCtx, key, data, u.Cfg.Cache.QrExpiration)
+	cacheCancel()
+
+	if err != nil {
+		u.Logger.Warn("Failed to cache QR code, allowing to continue", err)
+	}
+
+	return data, nil
+}
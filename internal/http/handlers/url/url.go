@@ -5,125 +5,397 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 	"url-shortener/internal/config"
 	"url-shortener/internal/kafka"
 	"url-shortener/internal/logger"
 	"url-shortener/internal/metrics"
+	"url-shortener/internal/middleware/auth"
 	"url-shortener/internal/middleware/ratelimiter"
 	"url-shortener/internal/middleware/requests"
 	"url-shortener/internal/models"
+	"url-shortener/internal/safety"
 	"url-shortener/internal/storage"
+	"url-shortener/internal/utils/agent"
+	"url-shortener/internal/utils/geo"
 	"url-shortener/internal/utils/url"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UrlHandler struct {
-	Cfg      *config.Config
-	Logger   logger.Logger
-	DB       storage.Database
-	Cache    storage.Cache
-	Producer *kafka.KafkaProducer
+	Cfg        *config.Config
+	Logger     logger.Logger
+	DB         storage.Database
+	Cache      storage.Cache
+	Producer   *kafka.KafkaProducer
+	Bots       *agent_utils.BotClassifier
+	Slugs      url_utils.SlugGenerator
+	Domains    *url_utils.Domains
+	Geo        *geo_utils.Locator
+	SlugMetric *metrics.SlugMetric
+	Safety     safety.SafetyChecker
+	Continue   *url_utils.ContinueTokens
 }
 
+// continueTTL is how long the continue link of an interstitial or an unlocked link stays valid
+const continueTTL = 10 * time.Minute
+
+// redirectStatuses are the redirect types a link can use, 301 and 308 may be cached by browsers
+var redirectStatuses = []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect}
+
 var (
-	ErrSlugExists = errors.New("Slug exists")
+	ErrSlugAttempts  = errors.New("no free slug found, slug space may be running out")
+	ErrUnknownDomain = errors.New("domain is not registered or not verified")
+	ErrForeignDomain = errors.New("domain is registered to another owner")
 )
 
-func AddUrlRoutes(r *gin.Engine, db storage.Database, cache storage.Cache, logger logger.Logger, producer *kafka.KafkaProducer, cfg *config.Config) {
+func AddUrlRoutes(r *gin.Engine, db storage.Database, cache storage.Cache, logger logger.Logger, producer *kafka.KafkaProducer, checker safety.SafetyChecker, cfg *config.Config) {
 	u := UrlHandler{
 		DB:       db,
 		Cache:    cache,
 		Logger:   logger,
 		Producer: producer,
 		Cfg:      cfg,
+		Bots:     agent_utils.NewBotClassifier(cfg.Server.BotPatterns),
+		Safety:   checker,
+	}
+
+	slugs, err := url_utils.NewSlugGenerator(cfg.Slug, db.NextSlugID)
+
+	if err != nil {
+		logger.Fatal("Slug generator error:", err)
+	}
+
+	u.Slugs = slugs
+
+	if !slices.Contains(redirectStatuses, cfg.Server.RedirectStatus) {
+		logger.Fatal("Redirect status must be one of 301, 302, 307, 308:", cfg.Server.RedirectStatus)
+	}
+
+	u.Domains, err = url_utils.NewDomains(cfg.Server)
+
+	if err != nil {
+		logger.Fatal("Base url error:", err)
+	}
+
+	u.Geo, err = geo_utils.NewLocator(cfg.Server.GeoDBPath)
+
+	if err != nil {
+		logger.Fatal("GeoIP database error:", err)
+	}
+
+	u.Continue, err = url_utils.NewContinueTokens(cfg.Auth.ContinueSecret, continueTTL)
+
+	if err != nil {
+		logger.Fatal("Continue token error:", err)
+	}
+
+	u.SlugMetric, err = metrics.NewSlugMetric()
+
+	if err != nil {
+		logger.Fatal("Slug metrics error:", err)
 	}
 
 	redirectMetric, _ := metrics.NewHttpMetric("redirect")
 	createMetric, _ := metrics.NewHttpMetric("shorten")
 	qrMetric, _ := metrics.NewHttpMetric("qrcode")
+	unlockMetric, _ := metrics.NewHttpMetric("unlock")
+	bulkMetric, _ := metrics.NewHttpMetric("bulk")
 
 	r.GET("/:slug", requests.LoggingMiddleware(u.Logger, *redirectMetric), ratelimiter.RateLimiter(10000, 100), u.RedirectHandler)
-	r.POST("/shorten", requests.LoggingMiddleware(u.Logger, *createMetric), ratelimiter.RateLimiter(100, 100), u.CreateUrlHandler)
+	r.POST("/:slug", requests.LoggingMiddleware(u.Logger, *unlockMetric), ratelimiter.RateLimiter(100, 100), u.UnlockHandler)
+	r.POST("/shorten", requests.LoggingMiddleware(u.Logger, *createMetric), ratelimiter.RateLimiter(100, 100), auth.Authenticate(db, logger, cfg, !cfg.Auth.AllowAnonymous), u.CreateUrlHandler)
+	r.POST("/api/links/bulk", requests.LoggingMiddleware(u.Logger, *bulkMetric), ratelimiter.RateLimiter(1, 5), auth.Authenticate(db, logger, cfg, !cfg.Auth.AllowAnonymous), u.BulkHandler)
 	r.GET("/qr/:slug", requests.LoggingMiddleware(u.Logger, *qrMetric), ratelimiter.RateLimiter(1000, 100), u.QrCodeHandler)
 }
 
 func (u *UrlHandler) RedirectHandler(c *gin.Context) {
 	slug := c.Param("slug")
 
-	err := url_utils.ValidateSlug(slug)
+	// /<slug>+ is the short form of ?preview=1
+	slug, preview := strings.CutSuffix(slug, "+")
+	preview = preview || c.Query("preview") == "1"
+
+	err := url_utils.ValidateSlug(slug, u.Cfg.Slug)
 
 	if err != nil {
 		c.Status(http.StatusNotFound)
 		return
 	}
 
+	// The same slug can exist once per domain, the Host header tells them apart
+	domain := u.Domains.Resolve(c.Request.Host)
+	key := url_utils.LinkKey(domain, slug)
+
+	link, err := u.lookup(key)
+
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// Expired rows linger until the scheduler deletes them
+	if link.Expires_at != nil && !link.Expires_at.After(time.Now()) {
+		c.Status(http.StatusGone)
+		return
+	}
+
+	if link.Disabled != "" {
+		u.renderWarning(c, key, link.Disabled)
+		return
+	}
+
+	// The continue link of an interstitial comes back with a signed go token, which is only
+	// handed out for protected links once the password was given
+	continued := u.Continue.Valid(key, c.Query("go"), time.Now())
+
+	// Protected links never redirect straight away, the form posts back to UnlockHandler
+	if link.PasswordHash != "" && !continued {
+		u.renderPasswordForm(c, slug, http.StatusOK, "")
+		return
+	}
+
+	if preview || (link.Interstitial && !continued) {
+		u.renderPreview(c, domain, slug, link, !preview)
+		return
+	}
+
+	// Links from before redirect types were stored follow the configured default
+	status := link.RedirectStatus
+
+	if status == 0 {
+		status = u.Cfg.Server.RedirectStatus
+	}
+
+	// Unlocked links are never cached, the same as when UnlockHandler redirects
+	if link.PasswordHash != "" {
+		status = http.StatusSeeOther
+	}
+
+	u.serve(c, key, link, status)
+}
+
+// serve enforces the click limit, records the click and redirects to the target
+func (u *UrlHandler) serve(c *gin.Context, key string, link models.UrlRecord, status int) {
+	if link.MaxClicks > 0 {
+		// Link previews and crawlers must not burn through one-time links, and a spoofed
+		// bot user agent must not bypass the limit either, so bots are turned away
+		if u.Bots.IsBot(c.Request.UserAgent()) {
+			c.Status(http.StatusForbidden)
+			return
+		}
+
+		allowed, err := u.consumeClick(key, link)
+
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		if !allowed {
+			c.Status(http.StatusGone)
+			return
+		}
+	}
+
+	select {
+	case u.Producer.EventChan <- u.newClickEvent(c, key, link.Expires_at):
+	//	u.Logger.Info("Event sent successfully")
+	default:
+		u.Logger.Warn("Dropping event, channel was full:", key)
+	}
+
+	// Browsers keep permanent redirects without asking again, which would hide edits and clicks
+	// past the link's lifetime. Click limited links have to be asked for every time, and where
+	// rules pick the target per visitor shared caches must not keep it.
+	if (status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect) && link.MaxClicks == 0 {
+		scope := "public"
+
+		if len(link.Rules) > 0 {
+			scope = "private"
+		}
+
+		maxAge := int(u.cacheTTL(link, u.Cfg.Cache.UrlExpiration).Seconds())
+		c.Header("Cache-Control", scope+", max-age="+strconv.Itoa(max(maxAge, 0)))
+	} else {
+		c.Header("Cache-Control", "no-store")
+	}
+
+	target := u.destination(c, link)
+
+	if link.ForwardQuery {
+		target = url_utils.ForwardQuery(target, c.Request.URL.Query(), internalParams)
+	}
+
+	u.Logger.Info("Redirect", target, key)
+	c.Redirect(status, target)
+}
+
+// consumeClick counts a click against the link's limit in postgres, so the limit holds across
+// instances and restarts and is never overshot. Redis only remembers links that are used up.
+// This puts one indexed UPDATE on the redirect path, a DB round trip more than a plain redirect,
+// but only for links with a limit that is not used up yet, every other redirect stays on redis.
+func (u *UrlHandler) consumeClick(key string, link models.UrlRecord) (bool, error) {
 	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), u.Cfg.Cache.Timeout)
 	defer cacheCancel()
 
-	longUrl, err := u.Cache.GetUrl(cacheCtx, slug)
+	reached, err := u.Cache.ClickLimitReached(cacheCtx, key)
 	cacheCancel()
 
-	if err == redis.Nil {
-		metrics.CacheMissesCounter.Add(1)
-		u.Logger.Warn("Cache missed", slug)
-	} else if err != nil {
+	if err != nil {
 		u.Logger.Error("Cache error:", err)
-		c.Status(http.StatusInternalServerError)
-		return
-	} else {
-		select {
-		case u.Producer.EventChan <- slug:
-		//	u.Logger.Info("Event sent successfully")
-		default:
-			u.Logger.Warn("Dropping event, channel was full TO PRODUCER:", slug)
-		}
+		return false, err
+	}
 
-		metrics.CacheHitsCounter.Add(1)
+	if reached {
+		return false, nil
+	}
 
-		u.Logger.Info("Redirect", longUrl, slug)
-		c.Redirect(http.StatusPermanentRedirect, longUrl)
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
+	defer dbCancel()
 
-		return
+	remaining, err := u.DB.ConsumeClick(dbCtx, key)
+	dbCancel()
+
+	if err != nil && err != sql.ErrNoRows {
+		u.Logger.Error("Postgres error:", err)
+		return false, err
 	}
 
+	if err == nil && remaining > 0 {
+		return true, nil
+	}
+
+	cacheCtx, cacheCancel = context.WithTimeout(context.Background(), u.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	cacheErr := u.Cache.SetClickLimitReached(cacheCtx, key, u.cacheTTL(link, 0))
+	cacheCancel()
+
+	if cacheErr != nil {
+		u.Logger.Warn("Failed to cache used up click limit, allowing to continue", key, cacheErr)
+	}
+
+	// The last click itself still goes through
+	return err == nil, nil
+}
+
+// destination picks the target of the first redirect rule the visitor matches, the long url otherwise
+func (u *UrlHandler) destination(c *gin.Context, link models.UrlRecord) string {
+	if len(link.Rules) == 0 {
+		return link.LongUrl
+	}
+
+	agent := agent_utils.Parse(c.Request.UserAgent())
+
+	target, ok := url_utils.MatchRule(link.Rules, url_utils.Visitor{
+		Country:  u.country(c),
+		Language: url_utils.PreferredLanguage(c.GetHeader("Accept-Language")),
+		OS:       agent.OS,
+		Device:   agent.Device,
+	})
+
+	if !ok {
+		return link.LongUrl
+	}
+
+	return target
+}
+
+// country looks the client up in the geo database and falls back to the header set by a proxy in front
+func (u *UrlHandler) country(c *gin.Context) string {
+	if country := u.Geo.Country(url_utils.GetIP(c.Request)); country != "" {
+		return country
+	}
+
+	// The header is optional, without one only the geo database is consulted
+	if u.Cfg.Server.CountryHeader == "" {
+		return ""
+	}
+
+	return strings.ToUpper(c.GetHeader(u.Cfg.Server.CountryHeader))
+}
+
+// lookup resolves a link key through the cache and falls back to postgres, caching what it finds
+func (u *UrlHandler) lookup(key string) (models.UrlRecord, error) {
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), u.Cfg.Cache.Timeout)
+	defer cacheCancel()
+
+	link, err := u.Cache.GetUrl(cacheCtx, key)
+	cacheCancel()
+
+	if err == nil {
+		metrics.CacheHitsCounter.Add(1)
+		return link, nil
+	}
+
+	if err != redis.Nil {
+		u.Logger.Error("Cache error:", err)
+		return link, err
+	}
+
+	metrics.CacheMissesCounter.Add(1)
+	u.Logger.Warn("Cache missed", key)
+
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
 	defer dbCancel()
 
-	longUrl, err = u.DB.GetUrl(dbCtx, slug)
+	link, err = u.DB.GetUrl(dbCtx, key)
 	dbCancel()
 
 	if err == sql.ErrNoRows {
-		c.Status(http.StatusNotFound)
-		return
+		return link, err
 	}
 
 	if err != nil {
 		u.Logger.Error("Postgres error:", err)
-		c.Status(http.StatusInternalServerError)
-		return
+		return link, err
+	}
+
+	ttl := u.cacheTTL(link, u.Cfg.Cache.UrlExpiration)
+
+	if ttl <= 0 {
+		return link, nil
 	}
 
 	cacheCtx, cacheCancel = context.WithTimeout(context.Background(), u.Cfg.Cache.Timeout)
 	defer cacheCancel()
 
-	err = u.Cache.StoreUrl(cacheCtx, slug, longUrl)
+	err = u.Cache.StoreUrl(cacheCtx, key, link, ttl)
 	cacheCancel()
 
 	if err != nil {
-		u.Logger.Warn("Failed to cache, allowing to continue", longUrl, slug, err)
+		u.Logger.Warn("Failed to cache, allowing to continue", link.LongUrl, key, err)
 	}
 
-	select {
-	case u.Producer.EventChan <- slug:
-	//	u.Logger.Info("Event sent successfully")
-	default:
-		u.Logger.Warn("Dropping event, channel was full:", slug)
+	return link, nil
+}
+
+// cacheTTL caps ttl at the remaining lifetime of the link, a zero ttl means no cap besides the link
+func (u *UrlHandler) cacheTTL(link models.UrlRecord, ttl time.Duration) time.Duration {
+	if link.Expires_at == nil {
+		return ttl
 	}
 
-	u.Logger.Info("Redirect", longUrl, slug)
-	c.Redirect(http.StatusPermanentRedirect, longUrl)
+	remaining := time.Until(*link.Expires_at)
+
+	if ttl == 0 || remaining < ttl {
+		return remaining
+	}
+
+	return ttl
 }
 
 func (u *UrlHandler) CreateUrlHandler(c *gin.Context) {
@@ -139,7 +411,16 @@ func (u *UrlHandler) CreateUrlHandler(c *gin.Context) {
 		return
 	}
 
-	err = url_utils.ValidateUrl(newUrl.LongUrl)
+	var ownerID *int64
+
+	if id, ok := auth.OwnerID(c); ok {
+		ownerID = &id
+	}
+
+	// A reused link keeps its own expiry, callers that asked for another one are told it differs
+	lifetimeSet := newUrl.Expires_at != nil || newUrl.TTL != "" || newUrl.Permanent
+
+	err = u.prepareUrl(&newUrl, ownerID, time.Now())
 
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -149,82 +430,374 @@ func (u *UrlHandler) CreateUrlHandler(c *gin.Context) {
 		return
 	}
 
-	var slug string
+	err = u.checkDomain(newUrl.Domain, ownerID)
 
-	if newUrl.CustomAlias != "" {
-		err = url_utils.ValidateSlug(newUrl.CustomAlias)
+	if errors.Is(err, ErrUnknownDomain) || errors.Is(err, ErrForeignDomain) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "domain not allowed",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "lookup fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	safetyCtx := safety.WithResolveBudget(c.Request.Context(), u.Cfg.Safety.ResolveBudget)
+
+	reason, err := u.Safety.Check(safetyCtx, newUrl.LongUrl)
+
+	if err == nil && reason == "" {
+		reason, err = safety.CheckRules(safetyCtx, u.Safety, newUrl.Rules)
+	}
+
+	if err != nil {
+		u.Logger.Error("Safety check error:", newUrl.LongUrl, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "safety check fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if reason != "" {
+		u.Logger.Warn("Unsafe url rejected", newUrl.LongUrl, reason)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "unsafe url",
+			"error":   reason,
+		})
+		return
+	}
+
+	newUrl.PasswordHash = ""
+	newUrl.Protected = newUrl.Password != ""
+
+	if newUrl.Protected {
+		hash, err := bcrypt.GenerateFromPassword([]byte(newUrl.Password), bcrypt.DefaultCost)
 
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "invalid alias",
+				"message": "validation fail",
 				"error":   err.Error(),
 			})
 			return
 		}
 
-		slug = newUrl.CustomAlias
-	} else {
-		slug, err = url_utils.GenerateSlug(7)
+		newUrl.PasswordHash = string(hash)
+		newUrl.Password = ""
+	}
 
-		if err != nil {
-			u.Logger.Error("Short url generation error:", err)
+	// Aliases, passwords, click limits and rules make a link unique, so only plain links are shared
+	if newUrl.ReuseExisting && newUrl.CustomAlias == "" && !newUrl.Protected && newUrl.MaxClicks == 0 && len(newUrl.Rules) == 0 {
+		dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
+		defer dbCancel()
+
+		existing, err := u.DB.FindUrl(dbCtx, newUrl)
+		dbCancel()
+
+		if err != nil && err != sql.ErrNoRows {
+			u.Logger.Error("Postgres error:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "generation fail",
+				"message": "lookup fail",
 				"error":   err.Error(),
 			})
+			return
+		}
+
+		if err == nil {
+			if existing.RedirectStatus == 0 {
+				existing.RedirectStatus = u.Cfg.Server.RedirectStatus
+			}
+
+			shortUrl := u.shortUrl(existing.Domain, existing.Slug)
+			qrUrl := u.shortUrl(existing.Domain, "qr/"+existing.Slug)
+
+			c.JSON(http.StatusOK, gin.H{
+				"message":         "existing link reused",
+				"short_url":       shortUrl,
+				"slug":            existing.Slug,
+				"domain":          existing.Domain,
+				"qr":              qrUrl,
+				"expires_at":      existing.Expires_at,
+				"redirect_status": existing.RedirectStatus,
+				"reused":          true,
+				"expiry_differs":  lifetimeSet && !sameExpiry(existing.Expires_at, newUrl.Expires_at),
+			})
 
+			u.Logger.Info("Short url reused", newUrl.LongUrl, shortUrl)
 			return
 		}
+	}
+
+	err = u.storeUrl(&newUrl)
+
+	if errors.Is(err, storage.ErrSlugExists) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "alias taken",
+			"error":   err.Error(),
+		})
+		return
+	}
 
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "store fail",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	slug := newUrl.Slug
+
+	shortUrl := u.shortUrl(newUrl.Domain, slug)
+	qrUrl := u.shortUrl(newUrl.Domain, "qr/"+slug)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":         "successfully created",
+		"long_url":        newUrl.LongUrl,
+		"short_url":       shortUrl,
+		"slug":            slug,
+		"domain":          newUrl.Domain,
+		"qr":              qrUrl,
+		"expires_at":      newUrl.Expires_at,
+		"max_clicks":      newUrl.MaxClicks,
+		"protected":       newUrl.Protected,
+		"redirect_status": newUrl.RedirectStatus,
+	})
+
+	u.Logger.Info("Short url created", newUrl.LongUrl, shortUrl)
+}
+
+// sameExpiry compares expiries to the second, nil meaning never
+func sameExpiry(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
+
+func (u *UrlHandler) shortUrl(domain string, path string) string {
+	return u.Domains.ShortUrl(domain, path)
+}
+
+// checkDomain lets links be created on the default domain or on a verified domain of their owner
+func (u *UrlHandler) checkDomain(domain string, ownerID *int64) error {
+	if domain == "" {
+		return nil
 	}
 
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
 	defer dbCancel()
 
-	err = u.DB.StoreUrl(dbCtx, newUrl.LongUrl, slug, u.Cfg.DB.UrlExpiration)
+	owner, err := u.DB.GetDomainOwner(dbCtx, domain)
 	dbCancel()
 
+	if err == sql.ErrNoRows {
+		return ErrUnknownDomain
+	}
+
 	if err != nil {
 		u.Logger.Error("Postgres error:", err)
+		return err
+	}
 
-		status := 500
+	if ownerID == nil || *ownerID != owner {
+		return ErrForeignDomain
+	}
+
+	return nil
+}
+
+// prepareUrl validates a new link and fills in everything derived from the request
+func (u *UrlHandler) prepareUrl(newUrl *models.Url, ownerID *int64, now time.Time) error {
+	err := url_utils.ValidateUrl(newUrl.LongUrl)
+
+	if err != nil {
+		return err
+	}
 
-		if errors.Is(err, ErrSlugExists) {
-			status = 400
+	err = url_utils.NormalizeRules(newUrl.Rules)
+
+	if err != nil {
+		return err
+	}
+
+	if newUrl.Utm != nil {
+		// Rule destinations belong to the same campaign
+		targets := []*string{&newUrl.LongUrl}
+
+		for i := range newUrl.Rules {
+			targets = append(targets, &newUrl.Rules[i].Url)
 		}
 
-		c.JSON(status, gin.H{
-			"message": "store fail",
-			"error":   err.Error(),
-		})
-		return
+		for _, target := range targets {
+			*target, err = url_utils.SetUtm(*target, *newUrl.Utm)
+
+			if err != nil {
+				return err
+			}
+
+			// The parameters may push the url past the length limit
+			err = url_utils.ValidateUrl(*target)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		newUrl.Utm = nil
 	}
 
-	shortUrl := "http://localhost:8080/" + slug
-	qrUrl := "http://localhost:8080/qr/" + slug
+	if newUrl.MaxClicks < 0 {
+		return errors.New("max_clicks can't be negative")
+	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"message":   "successfully created",
-		"short_url": shortUrl,
-		"slug":      slug,
-		"qr":        qrUrl,
-	})
+	if newUrl.RedirectStatus == 0 {
+		newUrl.RedirectStatus = u.Cfg.Server.RedirectStatus
+	}
 
-	u.Logger.Info("Short url created", newUrl.LongUrl, shortUrl)
+	if !slices.Contains(redirectStatuses, newUrl.RedirectStatus) {
+		return errors.New("redirect_status must be one of 301, 302, 307, 308")
+	}
+
+	if newUrl.CustomAlias != "" {
+		err = url_utils.ValidateSlug(newUrl.CustomAlias, u.Cfg.Slug)
+
+		if err != nil {
+			return errors.New("invalid alias: " + err.Error())
+		}
+	}
+
+	if utf8.RuneCountInString(newUrl.Title) > 255 {
+		return errors.New("title can't be longer than 255 characters")
+	}
+
+	newUrl.Domain = u.Domains.Resolve(newUrl.Domain)
+	newUrl.OwnerID = ownerID
+	newUrl.Created_at = now
+	newUrl.Expires_at, err = url_utils.ResolveExpiration(now, newUrl.Expires_at, newUrl.TTL, newUrl.Permanent, u.Cfg.DB.UrlExpiration, u.Cfg.DB.MaxUrlExpiration)
+
+	if err != nil {
+		return err
+	}
+
+	canonicalUrl, err := url_utils.CanonicalizeUrl(newUrl.LongUrl)
+
+	if err != nil {
+		return err
+	}
+
+	newUrl.LongUrlHash = url_utils.HashUrl(canonicalUrl)
+
+	return nil
 }
 
-func (u *UrlHandler) QrCodeHandler(c *gin.Context) {
-	slug := c.Param("slug")
+// storeUrl saves the link under its custom alias, or under a generated slug that is regenerated
+// on collision up to the configured number of attempts. A taken alias is reported as ErrSlugExists.
+func (u *UrlHandler) storeUrl(newUrl *models.Url) error {
+	if newUrl.CustomAlias != "" {
+		newUrl.Slug = newUrl.CustomAlias
+
+		dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
+		defer dbCancel()
+
+		err := u.DB.StoreUrl(dbCtx, *newUrl)
+		dbCancel()
+
+		if err != nil && !errors.Is(err, storage.ErrSlugExists) {
+			u.Logger.Error("Postgres error:", err)
+		}
+
+		return err
+	}
+
+	for attempt := 1; attempt <= u.Cfg.Slug.MaxAttempts; attempt++ {
+		slug, err := u.generateSlug()
+
+		if err != nil {
+			return err
+		}
+
+		newUrl.Slug = slug
+
+		dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
+		err = u.DB.StoreUrl(dbCtx, *newUrl)
+		dbCancel()
+
+		if !errors.Is(err, storage.ErrSlugExists) {
+			if err != nil {
+				u.Logger.Error("Postgres error:", err)
+			}
+
+			return err
+		}
+
+		u.SlugMetric.Collisions.Inc()
+		u.Logger.Warn("Slug collision, regenerating", slug, attempt)
+	}
+
+	return ErrSlugAttempts
+}
 
-	shortUrl := "http://localhost:8080/" + slug
+// generateSlug asks the configured strategy for a slug, the counter strategy takes its next id
+// from postgres
+func (u *UrlHandler) generateSlug() (string, error) {
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), u.Cfg.DB.Timeout)
+	defer dbCancel()
 
-	data, err := url_utils.GenerateQrCode(shortUrl)
+	slug, err := u.Slugs.Generate(dbCtx)
 
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
-		u.Logger.Error("QR code generation error:", err)
-		return
+		u.Logger.Error("Short url generation error:", err)
 	}
 
-	c.Data(http.StatusOK, "image/png", data)
+	return slug, err
+}
+
+const (
+	sourceQr     = "qr"
+	sourceDirect = "direct"
+)
+
+// internalParams steer the shortener itself and are never forwarded to the destination
+var internalParams = []string{"preview", "go", "src"}
+
+// clickSource tells QR scans apart from other clicks, QR codes encode the short url with src=qr
+func clickSource(c *gin.Context) string {
+	if c.Query("src") == sourceQr {
+		return sourceQr
+	}
+
+	return sourceDirect
+}
+
+// carryQuery keeps the request's query on links of the pages shown in front of the redirect,
+// so the src tag and parameters meant to be forwarded survive them
+func carryQuery(c *gin.Context, path string) string {
+	if c.Request.URL.RawQuery == "" {
+		return path
+	}
+
+	return path + "?" + c.Request.URL.RawQuery
+}
+
+func (u *UrlHandler) newClickEvent(c *gin.Context, key string, expiresAt *time.Time) models.ClickEvent {
+	return models.ClickEvent{
+		Version:   models.ClickEventVersion,
+		Slug:      key,
+		Referrer:  c.Request.Referer(),
+		UserAgent: c.Request.UserAgent(),
+		IP:        url_utils.GetIP(c.Request),
+		Country:   u.country(c),
+		Bot:       u.Bots.IsBot(c.Request.UserAgent()),
+		Source:    clickSource(c),
+		ExpiresAt: expiresAt,
+		Timestamp: time.Now(),
+	}
 }
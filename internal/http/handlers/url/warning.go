@@ -0,0 +1,41 @@
+package url
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>Link disabled</title>
+</head>
+<body>
+	<h1>This link has been disabled</h1>
+	<p>The destination of this link was flagged as unsafe, it may be used for phishing or to spread malware.</p>
+	<p><small>Reason: {{.Reason}}</small></p>
+</body>
+</html>
+`))
+
+// renderWarning replaces the redirect for links the safety checks disabled, the destination is never linked
+func (u *UrlHandler) renderWarning(c *gin.Context, key string, reason string) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusForbidden)
+
+	err := warningPage.Execute(c.Writer, gin.H{
+		"Reason": reason,
+	})
+
+	if err != nil {
+		u.Logger.Error("Template error:", err)
+	}
+
+	u.Logger.Warn("Disabled link requested", key)
+}
@@ -6,17 +6,25 @@ import (
 	"time"
 	"url-shortener/internal/config"
 	"url-shortener/internal/logger"
+	"url-shortener/internal/models"
 	"url-shortener/internal/storage"
+	"url-shortener/internal/utils/agent"
+	"url-shortener/internal/utils/url"
 
 	"github.com/segmentio/kafka-go"
 )
 
 type KafkaConsumer struct {
-	Reader   *kafka.Reader
-	Messages map[string]int64
-	MsgChan  chan string
-	Cache    storage.Cache
-	Cfg      *config.Config
+	Reader     *kafka.Reader
+	Messages   map[string]int64
+	Hourly     map[string]int64
+	BotClicks  map[string]int64
+	Breakdowns map[string]int64
+	Visitors   map[string][]string
+	Expiry     map[string]time.Time
+	MsgChan    chan models.ClickEvent
+	Cache      storage.Cache
+	Cfg        *config.Config
 }
 
 func NewConsumer(cfg *config.Config, cache storage.Cache, num int) *KafkaConsumer {
@@ -28,10 +36,15 @@ func NewConsumer(cfg *config.Config, cache storage.Cache, num int) *KafkaConsume
 			ReadBatchTimeout: cfg.Kafka.ReadBatchTimeout,
 			StartOffset:      kafka.LastOffset,
 		}),
-		Messages: make(map[string]int64),
-		MsgChan:  make(chan string, cfg.Kafka.ConsumerChannelSize),
-		Cache:    cache,
-		Cfg:      cfg,
+		Messages:   make(map[string]int64),
+		Hourly:     make(map[string]int64),
+		BotClicks:  make(map[string]int64),
+		Breakdowns: make(map[string]int64),
+		Visitors:   make(map[string][]string),
+		Expiry:     make(map[string]time.Time),
+		MsgChan:    make(chan models.ClickEvent, cfg.Kafka.ConsumerChannelSize),
+		Cache:      cache,
+		Cfg:        cfg,
 	}
 }
 
@@ -48,44 +61,147 @@ func (k *KafkaConsumer) Read(stop context.Context, logger logger.Logger, num int
 		case <-stop.Done():
 			logger.Info("Consumer worker stopped:", num)
 			k.Messages = nil
+			k.Hourly = nil
+			k.BotClicks = nil
+			k.Breakdowns = nil
+			k.Visitors = nil
+			k.Expiry = nil
 			return
 		case <-ticker.C:
-			if len(k.Messages) > 0 {
-				cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+			k.flush(logger, num)
+		case event := <-k.MsgChan:
+			k.record(event)
 
-				err := k.Cache.IncrementBatch(cacheCtx, "clicks", k.Messages, num)
-				cacheCancel()
-
-				if err != nil {
-					logger.Error("Failed to cache url clicks:", err)
-				} else {
-					clear(k.Messages)
-				}
+			logger.Info("Consumer read message in:", time.Since(st))
+			st = time.Now()
 
+			if len(k.Messages) >= 1000 || len(k.Hourly) >= 1000 || len(k.BotClicks) >= 1000 || len(k.Breakdowns) >= 1000 || len(k.Visitors) >= 1000 {
+				k.flush(logger, num)
 			}
-		case msg := <-k.MsgChan:
-			k.Messages[msg]++
+		}
+	}
+}
 
-			logger.Info("Consumer read message in:", time.Since(st))
-			st = time.Now()
+func (k *KafkaConsumer) record(event models.ClickEvent) {
+	if event.Bot {
+		k.BotClicks[event.Slug]++
+	} else {
+		k.Messages[event.Slug]++
 
-			if len(k.Messages) >= 1000 {
-				cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+		// Clicks count towards the hour they happened in, legacy messages carry no timestamp
+		clickedAt := event.Timestamp
 
-				err := k.Cache.IncrementBatch(cacheCtx, "clicks", k.Messages, num)
-				cacheCancel()
+		if clickedAt.IsZero() {
+			clickedAt = time.Now()
+		}
 
-				if err != nil {
-					logger.Error("Failed to cache url clicks:", err)
-				} else {
-					clear(k.Messages)
-				}
-			}
+		k.Hourly[url_utils.HourlyKey(event.Slug, clickedAt.UTC().Truncate(time.Hour))]++
+	}
+
+	// Legacy plain slug messages carry no request context to break down
+	if event.Version == 0 {
+		return
+	}
+
+	agent := agent_utils.Parse(event.UserAgent)
+
+	if event.Bot {
+		agent.Device = "bot"
+	} else {
+		k.Visitors[event.Slug] = append(k.Visitors[event.Slug], agent_utils.VisitorID(event.IP, event.UserAgent))
+
+		// A zero expiry keeps the sketch of a link that was made permanent
+		k.Expiry[event.Slug] = time.Time{}
+
+		if event.ExpiresAt != nil {
+			k.Expiry[event.Slug] = *event.ExpiresAt
+		}
+	}
+
+	k.Breakdowns[event.Slug+"|referrer|"+url_utils.ReferrerHost(event.Referrer)]++
+	k.Breakdowns[event.Slug+"|browser|"+agent.Browser]++
+	k.Breakdowns[event.Slug+"|os|"+agent.OS]++
+	k.Breakdowns[event.Slug+"|device|"+agent.Device]++
+
+	// Events from before QR scans were tagged are all direct clicks
+	source := event.Source
+
+	if source == "" {
+		source = "direct"
+	}
+
+	k.Breakdowns[event.Slug+"|source|"+source]++
+}
+
+func (k *KafkaConsumer) flush(logger logger.Logger, num int) {
+	if len(k.Messages) > 0 {
+		cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+
+		err := k.Cache.IncrementBatch(cacheCtx, "clicks", k.Messages, num)
+		cacheCancel()
+
+		if err != nil {
+			logger.Error("Failed to cache url clicks:", err)
+		} else {
+			clear(k.Messages)
+		}
+	}
+
+	if len(k.Hourly) > 0 {
+		cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+
+		err := k.Cache.IncrementBatch(cacheCtx, "clicks_hourly", k.Hourly, num)
+		cacheCancel()
+
+		if err != nil {
+			logger.Error("Failed to cache hourly clicks:", err)
+		} else {
+			clear(k.Hourly)
+		}
+	}
+
+	if len(k.BotClicks) > 0 {
+		cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+
+		err := k.Cache.IncrementBatch(cacheCtx, "bot_clicks", k.BotClicks, num)
+		cacheCancel()
+
+		if err != nil {
+			logger.Error("Failed to cache bot clicks:", err)
+		} else {
+			clear(k.BotClicks)
+		}
+	}
+
+	if len(k.Breakdowns) > 0 {
+		cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+
+		err := k.Cache.IncrementBatch(cacheCtx, "breakdowns", k.Breakdowns, num)
+		cacheCancel()
+
+		if err != nil {
+			logger.Error("Failed to cache click breakdowns:", err)
+		} else {
+			clear(k.Breakdowns)
+		}
+	}
+
+	if len(k.Visitors) > 0 {
+		cacheCtx, cacheCancel := context.WithTimeout(context.Background(), k.Cfg.Cache.Timeout)
+
+		err := k.Cache.AddVisitors(cacheCtx, k.Visitors, k.Expiry)
+		cacheCancel()
+
+		if err != nil {
+			logger.Error("Failed to cache unique visitors:", err)
+		} else {
+			clear(k.Visitors)
+			clear(k.Expiry)
 		}
 	}
 }
 
-func (k *KafkaConsumer) Fetcher(ctx context.Context, msgChan chan string, logger logger.Logger) {
+func (k *KafkaConsumer) Fetcher(ctx context.Context, msgChan chan models.ClickEvent, logger logger.Logger) {
 	defer close(msgChan)
 
 	commitBatch := time.NewTicker(k.Cfg.Kafka.CommitBatchTimeout)
@@ -123,8 +239,15 @@ func (k *KafkaConsumer) Fetcher(ctx context.Context, msgChan chan string, logger
 			continue
 		}
 
+		event, err := DecodeClickEvent(msg)
+
+		if err != nil {
+			logger.Warn("Consumer failed to decode message, skipping:", err)
+			continue
+		}
+
 		select {
-		case msgChan <- string(msg.Value):
+		case msgChan <- event:
 			batchMap[msg.Partition] = append(batchMap[msg.Partition], msg)
 
 			if len(batchMap[msg.Partition]) ==  k.Cfg.Kafka.CommitBatchSize {
@@ -0,0 +1,42 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"url-shortener/internal/models"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func EncodeClickEvent(event models.ClickEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// DecodeClickEvent accepts both JSON events and the plain slug messages
+// produced before events were versioned, so old messages still count during rollout.
+func DecodeClickEvent(msg kafka.Message) (models.ClickEvent, error) {
+	var event models.ClickEvent
+
+	if len(msg.Value) == 0 {
+		return event, errors.New("empty click event")
+	}
+
+	if msg.Value[0] != '{' {
+		event.Slug = string(msg.Value)
+		event.Timestamp = msg.Time
+
+		return event, nil
+	}
+
+	err := json.Unmarshal(msg.Value, &event)
+
+	if err != nil {
+		return event, err
+	}
+
+	if event.Slug == "" {
+		return event, errors.New("click event without slug")
+	}
+
+	return event, nil
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"url-shortener/internal/config"
 	"url-shortener/internal/logger"
+	"url-shortener/internal/models"
 
 	"github.com/segmentio/kafka-go"
 )
 
 type KafkaProducer struct {
 	Writer    *kafka.Writer
-	EventChan chan string
+	EventChan chan models.ClickEvent
 	Cfg       *config.Config
 }
 
@@ -24,7 +25,7 @@ func NewProducer(cfg *config.Config) *KafkaProducer {
 			RequiredAcks: 1,
 			Async:        true,
 		}),
-		EventChan: make(chan string, cfg.Kafka.ProducerChannelSize),
+		EventChan: make(chan models.ClickEvent, cfg.Kafka.ProducerChannelSize),
 		Cfg:       cfg,
 	}
 }
@@ -39,14 +40,21 @@ func (k *KafkaProducer) Write(stop context.Context, logger logger.Logger) {
 		case <-stop.Done():
 			logger.Info("Producer worker stopped")
 			return
-		case slug := <-k.EventChan:
+		case event := <-k.EventChan:
+			value, err := EncodeClickEvent(event)
+
+			if err != nil {
+				logger.Error("Kafka Producer failed to encode event:", event.Slug, err)
+				continue
+			}
+
 			partition := msgCount % 6
 			msgCount++
 
 			kafkaCtx, kafkaCancel := context.WithTimeout(context.Background(), k.Cfg.Kafka.ProducerTimeout)
 
-			err := k.Writer.WriteMessages(kafkaCtx, kafka.Message{
-				Value:     []byte(slug),
+			err = k.Writer.WriteMessages(kafkaCtx, kafka.Message{
+				Value:     value,
 				Partition: int(partition),
 			})
 
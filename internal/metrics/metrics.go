@@ -27,6 +27,10 @@ type CacheMetric struct {
 	TotalCacheMisses prometheus.Counter
 }
 
+type SlugMetric struct {
+	Collisions prometheus.Counter
+}
+
 func NewHttpMetric(name string) (*HttpMetric, error) {
 	Total := *prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: name + "_total",
@@ -86,6 +90,23 @@ func NewCacheMetric() (*CacheMetric, error) {
 	}, nil
 }
 
+func NewSlugMetric() (*SlugMetric, error) {
+	Collisions := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "slug_collisions_total",
+		Help: "Generated slugs that were already taken",
+	})
+
+	err := prometheus.Register(Collisions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SlugMetric{
+		Collisions: Collisions,
+	}, nil
+}
+
 func (h *HttpMetric) Export(method string, status string, latency time.Duration) {
 	h.TotalRequests.WithLabelValues(method, status).Inc()
 	h.LatencyRequests.Observe(latency.Seconds())
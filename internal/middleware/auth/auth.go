@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"url-shortener/internal/config"
+	"url-shortener/internal/logger"
+	"url-shortener/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ownerKey  = "owner_id"
+	keyPrefix = "usk_"
+)
+
+func GenerateKey() (string, error) {
+	buf := make([]byte, 32)
+
+	_, err := rand.Read(buf)
+
+	if err != nil {
+		return "", err
+	}
+
+	return keyPrefix + hex.EncodeToString(buf), nil
+}
+
+// HashKey is what gets stored, plain keys are only shown once when issued
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate resolves the API key to its owner. Requests without a key pass through
+// anonymously unless required is set, requests with an unknown or revoked key never do.
+func Authenticate(db storage.Database, logger logger.Logger, cfg *config.Config, required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := extractKey(c.Request)
+
+		if key == "" {
+			if required {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+
+			c.Next()
+			return
+		}
+
+		dbCtx, dbCancel := context.WithTimeout(context.Background(), cfg.DB.Timeout)
+		defer dbCancel()
+
+		ownerID, err := db.GetOwnerByKey(dbCtx, HashKey(key))
+		dbCancel()
+
+		if err == sql.ErrNoRows {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			logger.Error("Postgres error:", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Set(ownerKey, ownerID)
+
+		c.Next()
+	}
+}
+
+func OwnerID(c *gin.Context) (int64, bool) {
+	val, exists := c.Get(ownerKey)
+
+	if !exists {
+		return 0, false
+	}
+
+	ownerID, ok := val.(int64)
+
+	return ownerID, ok
+}
+
+func extractKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	header := r.Header.Get("Authorization")
+
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+
+	return ""
+}
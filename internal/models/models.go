@@ -3,9 +3,132 @@ package models
 import "time"
 
 type Url struct {
-	LongUrl     string    `json:"long_url"`
-	Slug        string    `json:"slug"`
-	CustomAlias string    `json:"alias"`
-	Created_at  time.Time `json:"created_at"`
-	Expires_at  time.Time `json:"expires_at"`
+	LongUrl        string         `json:"long_url"`
+	Slug           string         `json:"slug"`
+	Domain         string         `json:"domain,omitempty"`
+	CustomAlias    string         `json:"alias"`
+	Title          string         `json:"title,omitempty"`
+	Interstitial   bool           `json:"interstitial,omitempty"`
+	RedirectStatus int            `json:"redirect_status,omitempty"`
+	ForwardQuery   bool           `json:"forward_query,omitempty"`
+	Utm            *Utm           `json:"utm,omitempty"`
+	Rules          []RedirectRule `json:"rules,omitempty"`
+	Disabled       string         `json:"disabled,omitempty"`
+	OwnerID        *int64         `json:"owner_id,omitempty"`
+	Clicks         int64          `json:"clicks"`
+	TTL            string         `json:"ttl,omitempty"`
+	Permanent      bool           `json:"permanent,omitempty"`
+	MaxClicks      int64          `json:"max_clicks,omitempty"`
+	Password       string         `json:"password,omitempty"`
+	Protected      bool           `json:"protected,omitempty"`
+	PasswordHash   string         `json:"-"`
+	ReuseExisting  bool           `json:"reuse_existing,omitempty"`
+	LongUrlHash    string         `json:"-"`
+	Created_at     time.Time      `json:"created_at"`
+	Expires_at     *time.Time     `json:"expires_at"`
+}
+
+// Utm holds the campaign parameters that are set on the long url as utm_source, utm_medium and so on
+type Utm struct {
+	Source   string `json:"source"`
+	Medium   string `json:"medium"`
+	Campaign string `json:"campaign"`
+	Term     string `json:"term"`
+	Content  string `json:"content"`
+}
+
+// RedirectRule sends visitors matching every condition that is set to a destination of its own.
+// Rules are evaluated in order and the first match wins, links fall back to their long url.
+type RedirectRule struct {
+	Country  string `json:"country,omitempty"`
+	Language string `json:"language,omitempty"`
+	OS       string `json:"os,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Url      string `json:"url"`
+}
+
+// UrlRecord is everything the redirect path needs to serve a link, it is what gets cached under url:<link key>
+type UrlRecord struct {
+	LongUrl        string         `json:"long_url"`
+	Expires_at     *time.Time     `json:"expires_at,omitempty"`
+	MaxClicks      int64          `json:"max_clicks,omitempty"`
+	PasswordHash   string         `json:"password_hash,omitempty"`
+	Title          string         `json:"title,omitempty"`
+	Interstitial   bool           `json:"interstitial,omitempty"`
+	RedirectStatus int            `json:"redirect_status,omitempty"`
+	ForwardQuery   bool           `json:"forward_query,omitempty"`
+	Rules          []RedirectRule `json:"rules,omitempty"`
+	Disabled       string         `json:"disabled,omitempty"`
+}
+
+// UrlTarget is the minimum the safety re-check needs to walk all links
+type UrlTarget struct {
+	ID      int64
+	Key     string
+	LongUrl string
+	Rules   []RedirectRule
+}
+
+// UrlUpdate holds the fields a PATCH may change, nil means keep the current value
+type UrlUpdate struct {
+	LongUrl      *string         `json:"long_url"`
+	LongUrlHash  *string         `json:"-"`
+	Title        *string         `json:"title"`
+	Interstitial *bool           `json:"interstitial"`
+	ForwardQuery *bool           `json:"forward_query"`
+	Rules        *[]RedirectRule `json:"rules"`
+	TTL          *string         `json:"ttl"`
+	Permanent    bool            `json:"permanent"`
+	Expires_at   *time.Time      `json:"expires_at"`
+}
+
+type Stats struct {
+	Slug           string     `json:"slug"`
+	Domain         string     `json:"domain,omitempty"`
+	LongUrl        string     `json:"long_url"`
+	Clicks         int64      `json:"clicks"`
+	PendingClicks  int64      `json:"pending_clicks"`
+	TotalClicks    int64      `json:"total_clicks"`
+	BotClicks      int64      `json:"bot_clicks"`
+	UniqueVisitors int64      `json:"unique_visitors"`
+	Created_at     time.Time  `json:"created_at"`
+	Expires_at     *time.Time `json:"expires_at"`
+}
+
+type Domain struct {
+	Host         string     `json:"host"`
+	VerifiedAt   *time.Time `json:"verified_at"`
+	VerifyToken  string     `json:"-"`
+	VerifyRecord string     `json:"verify_record,omitempty"` // only shown until the domain is verified
+	VerifyValue  string     `json:"verify_value,omitempty"`
+	Created_at   time.Time  `json:"created_at"`
+}
+
+type ClicksPoint struct {
+	Bucket time.Time `json:"bucket"`
+	Count  int64     `json:"count"`
+}
+
+var BreakdownDimensions = []string{"referrer", "browser", "os", "device", "source"}
+
+type BreakdownEntry struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// ClickEventVersion is bumped whenever ClickEvent changes incompatibly.
+// Version 0 is reserved for legacy messages that carried only the slug.
+const ClickEventVersion = 1
+
+type ClickEvent struct {
+	Version   int        `json:"v"`
+	Slug      string     `json:"slug"` // the link key, domain/slug on branded domains
+	Referrer  string     `json:"referrer,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	IP        string     `json:"ip,omitempty"`
+	Country   string     `json:"country,omitempty"`
+	Bot       bool       `json:"bot,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // lets per-link state expire with the link
+	Timestamp time.Time  `json:"ts"`
 }
@@ -0,0 +1,131 @@
+package safety
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlocklistChecker flags urls whose host or any parent domain is listed in a local file.
+// The file holds one domain per line, # starts a comment and hosts file lines like
+// "0.0.0.0 evil.com" work too. It is reloaded when its modification time changes.
+type BlocklistChecker struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.RWMutex
+	domains   map[string]struct{}
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewBlocklistChecker loads the file once, after that it is checked for changes at most once per interval
+func NewBlocklistChecker(path string, interval time.Duration) (*BlocklistChecker, error) {
+	b := &BlocklistChecker{
+		path:     path,
+		interval: interval,
+	}
+
+	err := b.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *BlocklistChecker) Check(ctx context.Context, longUrl string) (string, error) {
+	b.reload()
+
+	host, err := Host(longUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, domain := range Domains(host) {
+		if _, ok := b.domains[domain]; ok {
+			return "domain " + domain + " is blocklisted", nil
+		}
+	}
+
+	return "", nil
+}
+
+// reload keeps serving the previous list if the file became unreadable, a broken deploy of the
+// list must not open the gates
+func (b *BlocklistChecker) reload() {
+	b.mu.RLock()
+	due := time.Since(b.checkedAt) >= b.interval
+	b.mu.RUnlock()
+
+	if !due {
+		return
+	}
+
+	b.load()
+}
+
+func (b *BlocklistChecker) load() error {
+	b.mu.Lock()
+	b.checkedAt = time.Now()
+	b.mu.Unlock()
+
+	info, err := os.Stat(b.path)
+
+	if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	unchanged := info.ModTime().Equal(b.modTime) && b.domains != nil
+	b.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(b.path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	domains := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		domain := strings.TrimSuffix(strings.ToLower(fields[len(fields)-1]), ".")
+		domains[domain] = struct{}{}
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.domains = domains
+	b.modTime = info.ModTime()
+	b.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package safety
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoopChecker flags destinations on the shortener's own domains, such a link can only
+// redirect to another short link or back to itself. Domains owners registered and verified at
+// runtime are looked up through registered.
+type LoopChecker struct {
+	domains    map[string]struct{}
+	registered func(ctx context.Context, host string) (bool, error)
+}
+
+func NewLoopChecker(domains []string, registered func(ctx context.Context, host string) (bool, error)) *LoopChecker {
+	return &LoopChecker{
+		domains:    domainSet(domains),
+		registered: registered,
+	}
+}
+
+func (l *LoopChecker) Check(ctx context.Context, longUrl string) (string, error) {
+	host, err := Host(longUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := l.domains[host]; ok {
+		return "destination " + host + " is this shortener", nil
+	}
+
+	if l.registered == nil {
+		return "", nil
+	}
+
+	ok, err := l.registered(ctx, host)
+
+	if err != nil || !ok {
+		return "", err
+	}
+
+	return "destination " + host + " is a domain of this shortener", nil
+}
+
+// RememberHosts caches the answers of registered for ttl, after that all of them are asked again
+func RememberHosts(registered func(ctx context.Context, host string) (bool, error), ttl time.Duration) func(ctx context.Context, host string) (bool, error) {
+	var mu sync.Mutex
+
+	known := make(map[string]bool)
+	since := time.Now()
+
+	return func(ctx context.Context, host string) (bool, error) {
+		mu.Lock()
+
+		if time.Since(since) > ttl {
+			clear(known)
+			since = time.Now()
+		}
+
+		ok, cached := known[host]
+		mu.Unlock()
+
+		if cached {
+			return ok, nil
+		}
+
+		ok, err := registered(ctx, host)
+
+		if err != nil {
+			return false, err
+		}
+
+		mu.Lock()
+		known[host] = ok
+		mu.Unlock()
+
+		return ok, nil
+	}
+}
+
+// knownShorteners are resolved out of the box, the configured shorteners are added to them
+var knownShorteners = []string{
+	"bit.ly", "buff.ly", "cutt.ly", "goo.gl", "is.gd", "ow.ly", "rb.gy", "rebrand.ly",
+	"shorturl.at", "t.co", "t.ly", "tiny.cc", "tinyurl.com", "v.gd",
+}
+
+// ShortenerResolver follows destinations on other known shorteners hop by hop and runs every hop
+// through the next checker, so a chain can neither hide a blocklisted target nor lead back here.
+// Chains longer than depth are rejected as well.
+//
+// Resolving fails closed: a chain that can't be followed, because a hop errors or the time budget
+// runs out, is flagged rather than let through, since an unreachable hop could hide anything.
+type ShortenerResolver struct {
+	next       SafetyChecker
+	shorteners map[string]struct{}
+	depth      int
+	budget     time.Duration
+	client     *http.Client
+}
+
+// NewShortenerResolver gives every hop timeout and all hops of one check budget together,
+// WithResolveBudget shares one budget between several checks
+func NewShortenerResolver(next SafetyChecker, shorteners []string, depth int, timeout time.Duration, budget time.Duration) *ShortenerResolver {
+	return &ShortenerResolver{
+		next:       next,
+		shorteners: domainSet(append(slices.Clone(knownShorteners), shorteners...)),
+		depth:      depth,
+		budget:     budget,
+		client: &http.Client{
+			Timeout: timeout,
+			// Every hop is inspected here instead of being followed blindly
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+type budgetKey struct{}
+
+// WithResolveBudget bounds the time all shortener hops followed with ctx may take together,
+// so checking many urls in one request can't take their number times the budget
+func WithResolveBudget(ctx context.Context, budget time.Duration) context.Context {
+	return context.WithValue(ctx, budgetKey{}, time.Now().Add(budget))
+}
+
+func (r *ShortenerResolver) Check(ctx context.Context, longUrl string) (string, error) {
+	current := longUrl
+	seen := make(map[string]bool)
+
+	deadline := time.Now().Add(r.budget)
+
+	if shared, ok := ctx.Value(budgetKey{}).(time.Time); ok && shared.Before(deadline) {
+		deadline = shared
+	}
+
+	// Only the hops are bounded, the checks of the next checker keep the caller's context
+	hopCtx, hopCancel := context.WithDeadline(ctx, deadline)
+	defer hopCancel()
+
+	for hop := 0; ; hop++ {
+		reason, err := r.next.Check(ctx, current)
+
+		if err != nil {
+			return "", err
+		}
+
+		if reason != "" {
+			if hop > 0 {
+				reason += fmt.Sprintf(" (reached after %d redirect(s))", hop)
+			}
+
+			return reason, nil
+		}
+
+		host, err := Host(current)
+
+		if err != nil {
+			return "", err
+		}
+
+		if !r.isShortener(host) {
+			return "", nil
+		}
+
+		if hop == r.depth {
+			return fmt.Sprintf("shortener chain is longer than %d redirect(s)", r.depth), nil
+		}
+
+		seen[current] = true
+
+		location, err := r.follow(hopCtx, current)
+
+		if err != nil {
+			return "shortener chain could not be resolved at " + host + ": " + err.Error(), nil
+		}
+
+		// The shortener answered without a redirect, nothing left to follow
+		if location == "" {
+			return "", nil
+		}
+
+		if seen[location] {
+			return "shortener chain loops through " + host, nil
+		}
+
+		current = location
+	}
+}
+
+func (r *ShortenerResolver) isShortener(host string) bool {
+	for _, domain := range Domains(host) {
+		if _, ok := r.shorteners[domain]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// follow returns the absolute redirect target of rawUrl, or an empty string if it does not redirect
+func (r *ShortenerResolver) follow(ctx context.Context, rawUrl string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	res, err := r.client.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode < 300 || res.StatusCode > 399 {
+		return "", nil
+	}
+
+	location, err := res.Location()
+
+	if err != nil {
+		return "", errors.New("redirect without location from " + req.URL.Host)
+	}
+
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return "", errors.New("redirect to unsupported scheme " + location.Scheme)
+	}
+
+	return location.String(), nil
+}
+
+func domainSet(domains []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(domains))
+
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+
+		// Accept full urls and host:port too, only the host counts
+		if u, err := url.Parse("//" + strings.TrimPrefix(strings.TrimPrefix(domain, "https://"), "http://")); err == nil {
+			domain = u.Hostname()
+		}
+
+		if domain != "" {
+			set[domain] = struct{}{}
+		}
+	}
+
+	return set
+}
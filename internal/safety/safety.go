@@ -0,0 +1,74 @@
+package safety
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"url-shortener/internal/models"
+)
+
+// SafetyChecker decides whether a destination may be shortened and served.
+// A non-empty reason flags the url, an error means the checker could not decide.
+type SafetyChecker interface {
+	Check(ctx context.Context, longUrl string) (string, error)
+}
+
+// Chain runs checkers in order and stops at the first one that flags the url
+type Chain []SafetyChecker
+
+func (ch Chain) Check(ctx context.Context, longUrl string) (string, error) {
+	for _, checker := range ch {
+		reason, err := checker.Check(ctx, longUrl)
+
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	return "", nil
+}
+
+// CheckRules runs checker on the destination of every redirect rule, a flagged rule is named in the reason
+func CheckRules(ctx context.Context, checker SafetyChecker, rules []models.RedirectRule) (string, error) {
+	for i, rule := range rules {
+		reason, err := checker.Check(ctx, rule.Url)
+
+		if err != nil {
+			return "", err
+		}
+
+		if reason != "" {
+			return fmt.Sprintf("rules[%d]: %s", i, reason), nil
+		}
+	}
+
+	return "", nil
+}
+
+// Host returns the lowercased host of a url without port and trailing dot
+func Host(longUrl string) (string, error) {
+	u, err := url.Parse(longUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), nil
+}
+
+// Domains lists the host and every parent domain, a.b.c gives a.b.c, b.c and c
+func Domains(host string) []string {
+	domains := []string{host}
+
+	for {
+		i := strings.IndexByte(host, '.')
+
+		if i < 0 {
+			return domains
+		}
+
+		host = host[i+1:]
+		domains = append(domains, host)
+	}
+}
@@ -3,34 +3,188 @@ package postgres
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"encoding/json"
+	"strconv"
 	"time"
+	"url-shortener/internal/models"
+	"url-shortener/internal/storage"
+
+	"github.com/lib/pq"
 )
 
-func (d *PostgresDB) StoreUrl(ctx context.Context, longUrl string, slug string, expiration time.Duration) error {
+// urlColumns and scanUrl keep every query that returns full links in the same shape
+const urlColumns = `long_url, slug, COALESCE(domain, ''), owner_id, clicks, COALESCE(max_clicks, 0), password_hash IS NOT NULL,
+	COALESCE(title, ''), interstitial, COALESCE(redirect_status, 0), forward_query, rules,
+	COALESCE(disabled_reason, ''), created_at, expires_at`
+
+func scanUrl(row interface{ Scan(...any) error }, url *models.Url) error {
+	var rules []byte
+
+	err := row.Scan(&url.LongUrl, &url.Slug, &url.Domain, &url.OwnerID, &url.Clicks, &url.MaxClicks, &url.Protected,
+		&url.Title, &url.Interstitial, &url.RedirectStatus, &url.ForwardQuery, &rules,
+		&url.Disabled, &url.Created_at, &url.Expires_at)
+
+	if err != nil {
+		return err
+	}
+
+	return decodeRules(rules, &url.Rules)
+}
+
+// encodeRules turns redirect rules into JSONB input, writes store an empty list as NULL through NULLIF
+func encodeRules(rules []models.RedirectRule) (string, error) {
+	if len(rules) == 0 {
+		return "[]", nil
+	}
+
+	data, err := json.Marshal(rules)
+
+	return string(data), err
+}
+
+func decodeRules(data []byte, rules *[]models.RedirectRule) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, rules)
+}
+
+func (d *PostgresDB) StoreUrl(ctx context.Context, url models.Url) error {
+	rules, err := encodeRules(url.Rules)
+
+	if err != nil {
+		return err
+	}
+
 	res, err := d.db.ExecContext(ctx, `
-		INSERT INTO urls (long_url, slug, created_at, expires_at)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (slug) DO NOTHING`,
-		longUrl,
-		slug,
-		time.Now(),
-		time.Now().Add(expiration),
+		INSERT INTO urls (long_url, long_url_hash, slug, title, interstitial, owner_id, max_clicks, password_hash, created_at, expires_at, domain,
+			redirect_status, forward_query, rules)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14::jsonb, '[]'::jsonb))
+		ON CONFLICT (link_key) DO NOTHING`,
+		url.LongUrl,
+		sql.NullString{String: url.LongUrlHash, Valid: url.LongUrlHash != ""},
+		url.Slug,
+		sql.NullString{String: url.Title, Valid: url.Title != ""},
+		url.Interstitial,
+		url.OwnerID,
+		sql.NullInt64{Int64: url.MaxClicks, Valid: url.MaxClicks > 0},
+		sql.NullString{String: url.PasswordHash, Valid: url.PasswordHash != ""},
+		url.Created_at,
+		url.Expires_at,
+		sql.NullString{String: url.Domain, Valid: url.Domain != ""},
+		sql.NullInt64{Int64: int64(url.RedirectStatus), Valid: url.RedirectStatus != 0},
+		url.ForwardQuery,
+		rules,
 	)
 
+	if err != nil {
+		return err
+	}
+
 	rows, _ := res.RowsAffected()
 
 	if rows == 0 {
-		return errors.New("Slug exists")
+		return storage.ErrSlugExists
 	}
 
-	return err
+	return nil
+}
+
+// StoreUrls inserts the whole batch in one statement and returns the link keys that were free.
+// Every link in a batch shares owner and creation time, passwords are not supported here.
+func (d *PostgresDB) StoreUrls(ctx context.Context, urls []models.Url) (map[string]bool, error) {
+	if len(urls) == 0 {
+		return map[string]bool{}, nil
+	}
+
+	longUrls := make([]string, len(urls))
+	hashes := make([]string, len(urls))
+	slugs := make([]string, len(urls))
+	maxClicks := make([]int64, len(urls))
+	expiresAt := make([]string, len(urls))
+	titles := make([]string, len(urls))
+	interstitials := make([]bool, len(urls))
+	domains := make([]string, len(urls))
+	statuses := make([]int64, len(urls))
+	forwards := make([]bool, len(urls))
+	rules := make([]string, len(urls))
+
+	for i, url := range urls {
+		var err error
+
+		rules[i], err = encodeRules(url.Rules)
+
+		if err != nil {
+			return nil, err
+		}
+
+		longUrls[i] = url.LongUrl
+		hashes[i] = url.LongUrlHash
+		slugs[i] = url.Slug
+		maxClicks[i] = url.MaxClicks
+		titles[i] = url.Title
+		interstitials[i] = url.Interstitial
+		domains[i] = url.Domain
+		statuses[i] = int64(url.RedirectStatus)
+		forwards[i] = url.ForwardQuery
+
+		if url.Expires_at != nil {
+			expiresAt[i] = url.Expires_at.Format(time.RFC3339Nano)
+		}
+	}
+
+	rows, err := d.db.QueryContext(ctx, `
+		INSERT INTO urls (long_url, long_url_hash, slug, title, interstitial, owner_id, max_clicks, created_at, expires_at, domain, redirect_status,
+			forward_query, rules)
+		SELECT l, NULLIF(h, ''), s, NULLIF(t, ''), i, $8::bigint, NULLIF(m, 0), $9, NULLIF(e, '')::timestamptz, NULLIF(d, ''), NULLIF(r, 0), f,
+			NULLIF(ru::jsonb, '[]'::jsonb)
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::bigint[], $5::text[], $6::text[], $7::boolean[], $10::text[], $11::smallint[],
+			$12::boolean[], $13::text[]) AS u (l, h, s, m, e, t, i, d, r, f, ru)
+		ON CONFLICT (link_key) DO NOTHING
+		RETURNING link_key`,
+		pq.Array(longUrls),
+		pq.Array(hashes),
+		pq.Array(slugs),
+		pq.Array(maxClicks),
+		pq.Array(expiresAt),
+		pq.Array(titles),
+		pq.Array(interstitials),
+		urls[0].OwnerID,
+		urls[0].Created_at,
+		pq.Array(domains),
+		pq.Array(statuses),
+		pq.Array(forwards),
+		pq.Array(rules),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stored := make(map[string]bool, len(urls))
+
+	for rows.Next() {
+		var key string
+
+		err = rows.Scan(&key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stored[key] = true
+	}
+
+	return stored, rows.Err()
 }
 
 func (d *PostgresDB) SlugExists(ctx context.Context, key string) (bool, error) {
 	i := 0
 
-	row := d.db.QueryRowContext(ctx, "SELECT 1 FROM urls WHERE slug = $1", key)
+	row := d.db.QueryRowContext(ctx, "SELECT 1 FROM urls WHERE link_key = $1", key)
 
 	err := row.Scan(&i)
 
@@ -45,18 +199,589 @@ func (d *PostgresDB) SlugExists(ctx context.Context, key string) (bool, error) {
 	return true, nil
 }
 
-func (d *PostgresDB) GetUrl(ctx context.Context, key string) (string, error) {
-	longUrl := ""
+// FindUrl returns the newest live link that could stand in for link: same owner, domain, url hash,
+// redirect status, title, interstitial and query forwarding. Links with a password, a click limit or redirect rules are never shared, and
+// a permanent link only stands in for another permanent one.
+func (d *PostgresDB) FindUrl(ctx context.Context, link models.Url) (models.Url, error) {
+	var url models.Url
+
+	// Links without a stored status follow the configured default
+	args := []any{link.LongUrlHash, sql.NullString{String: link.Domain, Valid: link.Domain != ""}, link.RedirectStatus,
+		d.Cfg.Server.RedirectStatus, link.Title, link.Interstitial, link.ForwardQuery, link.OwnerID}
+
+	owner := "owner_id = $8"
+
+	if link.OwnerID == nil {
+		owner = "owner_id IS NULL"
+		args = args[:7]
+	}
+
+	expiry := "(expires_at IS NULL OR expires_at > NOW())"
+
+	if link.Expires_at == nil {
+		expiry = "expires_at IS NULL"
+	}
+
+	row := d.db.QueryRowContext(ctx, `
+		SELECT `+urlColumns+`
+		FROM urls
+		WHERE `+owner+` AND long_url_hash = $1 AND domain IS NOT DISTINCT FROM $2 AND `+expiry+`
+			AND COALESCE(redirect_status, $4) = $3 AND COALESCE(title, '') = $5 AND interstitial = $6 AND forward_query = $7
+			AND password_hash IS NULL AND max_clicks IS NULL AND rules IS NULL AND disabled_at IS NULL
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1`,
+		args...,
+	)
+
+	err := scanUrl(row, &url)
+
+	return url, err
+}
+
+func (d *PostgresDB) NextSlugID(ctx context.Context) (int64, error) {
+	var id int64
+
+	err := d.db.QueryRowContext(ctx, "SELECT nextval('slug_counter_seq')").Scan(&id)
+
+	return id, err
+}
+
+func (d *PostgresDB) GetUrl(ctx context.Context, key string) (models.UrlRecord, error) {
+	var link models.UrlRecord
+	var rules []byte
+
+	row := d.db.QueryRowContext(ctx, `
+		SELECT long_url, expires_at, COALESCE(max_clicks, 0), COALESCE(password_hash, ''), COALESCE(title, ''), interstitial,
+			COALESCE(redirect_status, 0), forward_query, rules, COALESCE(disabled_reason, '')
+		FROM urls
+		WHERE link_key = $1`, key)
+
+	err := row.Scan(&link.LongUrl, &link.Expires_at, &link.MaxClicks, &link.PasswordHash, &link.Title, &link.Interstitial,
+		&link.RedirectStatus, &link.ForwardQuery, &rules, &link.Disabled)
+
+	if err != nil {
+		return link, err
+	}
+
+	err = decodeRules(rules, &link.Rules)
+
+	return link, err
+}
+
+func (d *PostgresDB) GetUrlOwner(ctx context.Context, key string) (*int64, error) {
+	var owner sql.NullInt64
+
+	row := d.db.QueryRowContext(ctx, "SELECT owner_id FROM urls WHERE link_key = $1", key)
+
+	err := row.Scan(&owner)
+
+	if err != nil || !owner.Valid {
+		return nil, err
+	}
+
+	return &owner.Int64, nil
+}
+
+// ConsumeClick takes one click off the limit of a link and returns the clicks left. The row lock
+// keeps the count exact across instances, sql.ErrNoRows means the limit is used up.
+func (d *PostgresDB) ConsumeClick(ctx context.Context, key string) (int64, error) {
+	var remaining int64
+
+	row := d.db.QueryRowContext(ctx, `
+		UPDATE urls
+		SET clicks_used = clicks_used + 1
+		WHERE link_key = $1 AND clicks_used < max_clicks
+		RETURNING max_clicks - clicks_used`, key)
+
+	err := row.Scan(&remaining)
+
+	return remaining, err
+}
+
+func (d *PostgresDB) ListUrls(ctx context.Context, ownerID int64, limit int, offset int) ([]models.Url, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT `+urlColumns+`
+		FROM urls
+		WHERE owner_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`,
+		ownerID,
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	urls := []models.Url{}
+
+	for rows.Next() {
+		var url models.Url
+
+		err = scanUrl(rows, &url)
+
+		if err != nil {
+			return nil, err
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
+
+// exportBatchSize is how many rows each FETCH pulls from the export cursor
+const exportBatchSize = 1000
+
+// ExportUrls walks all links of an owner through a server-side cursor and hands them to fn one by one,
+// so only a single batch is held in memory. An error from fn stops the export and is returned as is.
+func (d *PostgresDB) ExportUrls(ctx context.Context, ownerID int64, fn func(models.Url) error) error {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DECLARE export_cursor NO SCROLL CURSOR FOR
+		SELECT `+urlColumns+`
+		FROM urls
+		WHERE owner_id = $1
+		ORDER BY created_at, id`,
+		ownerID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		rows, err := tx.QueryContext(ctx, "FETCH FORWARD "+strconv.Itoa(exportBatchSize)+" FROM export_cursor")
+
+		if err != nil {
+			return err
+		}
+
+		fetched := 0
+
+		for rows.Next() {
+			var url models.Url
+
+			err = scanUrl(rows, &url)
+
+			if err == nil {
+				err = fn(url)
+			}
+
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			fetched++
+		}
+
+		err = rows.Err()
+		rows.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if fetched < exportBatchSize {
+			break
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *PostgresDB) UpdateUrl(ctx context.Context, key string, update models.UrlUpdate) (models.Url, error) {
+	var url models.Url
+
+	// nil keeps the current rules, an empty list removes them
+	var rules sql.NullString
+
+	if update.Rules != nil {
+		encoded, err := encodeRules(*update.Rules)
+
+		if err != nil {
+			return url, err
+		}
+
+		rules = sql.NullString{String: encoded, Valid: true}
+	}
+
+	row := d.db.QueryRowContext(ctx, `
+		UPDATE urls
+		SET long_url = COALESCE($2, long_url), long_url_hash = COALESCE($5, long_url_hash),
+			expires_at = CASE WHEN $4 THEN NULL ELSE COALESCE($3, expires_at) END,
+			title = CASE WHEN $6::text IS NULL THEN title ELSE NULLIF($6, '') END,
+			interstitial = COALESCE($7, interstitial),
+			forward_query = COALESCE($8, forward_query),
+			rules = CASE WHEN $9::jsonb IS NULL THEN rules ELSE NULLIF($9::jsonb, '[]'::jsonb) END,
+			disabled_at = CASE WHEN $2::text IS NULL THEN disabled_at END,
+			disabled_reason = CASE WHEN $2::text IS NULL THEN disabled_reason END
+		WHERE link_key = $1
+		RETURNING `+urlColumns,
+		key,
+		update.LongUrl,
+		update.Expires_at,
+		update.Permanent,
+		update.LongUrlHash,
+		update.Title,
+		update.Interstitial,
+		update.ForwardQuery,
+		rules,
+	)
+
+	err := scanUrl(row, &url)
+
+	return url, err
+}
+
+// ListActiveUrls pages through links that are neither disabled nor expired by id, starting after afterID
+func (d *PostgresDB) ListActiveUrls(ctx context.Context, afterID int64, limit int) ([]models.UrlTarget, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, link_key, long_url, rules
+		FROM urls
+		WHERE id > $1 AND disabled_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY id
+		LIMIT $2`,
+		afterID,
+		limit,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var urls []models.UrlTarget
+
+	for rows.Next() {
+		var url models.UrlTarget
+		var rules []byte
+
+		err = rows.Scan(&url.ID, &url.Key, &url.LongUrl, &rules)
+
+		if err == nil {
+			err = decodeRules(rules, &url.Rules)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
+
+func (d *PostgresDB) DisableUrl(ctx context.Context, key string, reason string) error {
+	if runes := []rune(reason); len(runes) > 255 {
+		reason = string(runes[:255])
+	}
+
+	res, err := d.db.ExecContext(ctx, "UPDATE urls SET disabled_at = NOW(), disabled_reason = $2 WHERE link_key = $1", key, reason)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := res.RowsAffected()
+
+	if err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return err
+}
+
+func (d *PostgresDB) DeleteUrl(ctx context.Context, key string) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM urls WHERE link_key = $1", key)
 
-	row := d.db.QueryRowContext(ctx, "SELECT long_url FROM urls WHERE slug = $1", key)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := res.RowsAffected()
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (d *PostgresDB) GetStats(ctx context.Context, key string) (models.Stats, error) {
+	var stats models.Stats
+
+	row := d.db.QueryRowContext(ctx, `
+		SELECT slug, COALESCE(domain, ''), long_url, clicks, bot_clicks, unique_visitors, created_at, expires_at
+		FROM urls
+		WHERE link_key = $1`, key)
+
+	err := row.Scan(&stats.Slug, &stats.Domain, &stats.LongUrl, &stats.Clicks, &stats.BotClicks, &stats.UniqueVisitors, &stats.Created_at, &stats.Expires_at)
+
+	return stats, err
+}
+
+func (d *PostgresDB) GetClicksTimeseries(ctx context.Context, key string, granularity string, from time.Time, to time.Time) ([]models.ClicksPoint, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT date_trunc($2, bucket, 'UTC') AS period, SUM(count)
+		FROM clicks_hourly
+		WHERE slug = $1 AND bucket >= $3 AND bucket < $4
+		GROUP BY period
+		ORDER BY period`,
+		key,
+		granularity,
+		from,
+		to,
+	)
+
+	if err != nil {
+		return nil, err
+	}
 
-	err := row.Scan(&longUrl)
+	defer rows.Close()
+
+	points := []models.ClicksPoint{}
+
+	for rows.Next() {
+		var point models.ClicksPoint
+
+		err = rows.Scan(&point.Bucket, &point.Count)
+
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, point)
+	}
+
+	return points, rows.Err()
+}
+
+func (d *PostgresDB) GetBreakdown(ctx context.Context, key string, dimension string, limit int) ([]models.BreakdownEntry, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT value, count
+		FROM clicks_breakdown
+		WHERE slug = $1 AND dimension = $2
+		ORDER BY count DESC, value
+		LIMIT $3`,
+		key,
+		dimension,
+		limit,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []models.BreakdownEntry{}
+
+	for rows.Next() {
+		var entry models.BreakdownEntry
+
+		err = rows.Scan(&entry.Value, &entry.Count)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// CreateDomain registers host unverified. A claim left unverified for a day without links can be
+// taken over by another owner, so nobody can hold on to a host they don't control.
+func (d *PostgresDB) CreateDomain(ctx context.Context, ownerID int64, host string) (models.Domain, error) {
+	domain := models.Domain{Host: host}
+
+	row := d.db.QueryRowContext(ctx, `
+		INSERT INTO domains (host, owner_id)
+		VALUES ($1, $2)
+		ON CONFLICT (host) DO UPDATE
+		SET owner_id = EXCLUDED.owner_id, verify_token = md5(gen_random_uuid()::text), created_at = NOW()
+		WHERE domains.verified_at IS NULL AND domains.owner_id <> EXCLUDED.owner_id
+			AND domains.created_at < NOW() - INTERVAL '1 day'
+			AND NOT EXISTS (SELECT 1 FROM urls WHERE urls.domain = domains.host)
+		RETURNING verify_token, created_at`,
+		host,
+		ownerID,
+	)
+
+	err := row.Scan(&domain.VerifyToken, &domain.Created_at)
+
+	if err == sql.ErrNoRows {
+		return domain, storage.ErrDomainExists
+	}
+
+	return domain, err
+}
+
+// GetDomainOwner only knows verified domains, an unverified claim must not affect anybody's links
+func (d *PostgresDB) GetDomainOwner(ctx context.Context, host string) (int64, error) {
+	var ownerID int64
+
+	err := d.db.QueryRowContext(ctx, "SELECT owner_id FROM domains WHERE host = $1 AND verified_at IS NOT NULL", host).Scan(&ownerID)
+
+	return ownerID, err
+}
+
+func (d *PostgresDB) GetDomain(ctx context.Context, ownerID int64, host string) (models.Domain, error) {
+	var domain models.Domain
+
+	row := d.db.QueryRowContext(ctx, `
+		SELECT host, verify_token, verified_at, created_at
+		FROM domains
+		WHERE host = $1 AND owner_id = $2`,
+		host,
+		ownerID,
+	)
+
+	err := row.Scan(&domain.Host, &domain.VerifyToken, &domain.VerifiedAt, &domain.Created_at)
+
+	return domain, err
+}
+
+func (d *PostgresDB) VerifyDomain(ctx context.Context, ownerID int64, host string) error {
+	res, err := d.db.ExecContext(ctx, "UPDATE domains SET verified_at = COALESCE(verified_at, NOW()) WHERE host = $1 AND owner_id = $2", host, ownerID)
+
+	if err != nil {
+		return err
+	}
+
+	rows, _ := res.RowsAffected()
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (d *PostgresDB) ListDomains(ctx context.Context, ownerID int64) ([]models.Domain, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT host, verify_token, verified_at, created_at FROM domains WHERE owner_id = $1 ORDER BY host", ownerID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	domains := []models.Domain{}
+
+	for rows.Next() {
+		var domain models.Domain
+
+		err = rows.Scan(&domain.Host, &domain.VerifyToken, &domain.VerifiedAt, &domain.Created_at)
+
+		if err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, rows.Err()
+}
+
+// DeleteDomain refuses to drop a domain that still has links, they would stop resolving silently
+func (d *PostgresDB) DeleteDomain(ctx context.Context, ownerID int64, host string) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM domains WHERE host = $1 AND owner_id = $2", host, ownerID)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		return storage.ErrDomainInUse
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rows, _ := res.RowsAffected()
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (d *PostgresDB) GetOwnerByKey(ctx context.Context, keyHash string) (int64, error) {
+	var ownerID int64
+
+	row := d.db.QueryRowContext(ctx, "SELECT owner_id FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", keyHash)
+
+	err := row.Scan(&ownerID)
+
+	return ownerID, err
+}
+
+func (d *PostgresDB) CreateApiKey(ctx context.Context, owner string, keyHash string) (int64, error) {
+	var ownerID int64
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		INSERT INTO owners (name)
+		VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id`,
+		owner,
+	)
+
+	err = row.Scan(&ownerID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO api_keys (owner_id, key_hash) VALUES ($1, $2)", ownerID, keyHash)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return ownerID, tx.Commit()
+}
+
+func (d *PostgresDB) RevokeApiKey(ctx context.Context, keyHash string) error {
+	res, err := d.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE key_hash = $1 AND revoked_at IS NULL", keyHash)
+
+	if err != nil {
+		return err
+	}
+
+	rows, _ := res.RowsAffected()
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
 
-	return longUrl, err
+	return nil
 }
 
 func (d *PostgresDB) CleanUp(ctx context.Context) error {
-	_, err := d.db.ExecContext(ctx, "TRUNCATE TABLE urls RESTART IDENTITY")
+	_, err := d.db.ExecContext(ctx, "TRUNCATE TABLE urls RESTART IDENTITY CASCADE")
 	return err
 }
 
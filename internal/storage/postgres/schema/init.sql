@@ -1,8 +1,124 @@
+-- Safe to run again on every release: tables created by an earlier version are brought up to
+-- date by the ALTER statements below, which change nothing on a current database. Needs
+-- PostgreSQL 13 or later for gen_random_uuid.
+
+CREATE TABLE IF NOT EXISTS owners (
+    id          BIGSERIAL       PRIMARY KEY,
+    name        VARCHAR(64)     NOT NULL UNIQUE,
+    created_at  TIMESTAMPTZ     DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id          BIGSERIAL       PRIMARY KEY,
+    owner_id    BIGINT          NOT NULL REFERENCES owners (id) ON DELETE CASCADE,
+    key_hash    CHAR(64)        NOT NULL UNIQUE,
+    created_at  TIMESTAMPTZ     DEFAULT CURRENT_TIMESTAMP,
+    revoked_at  TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS domains (
+    id          BIGSERIAL       PRIMARY KEY,
+    host        VARCHAR(253)    NOT NULL UNIQUE,
+    owner_id    BIGINT          NOT NULL REFERENCES owners (id) ON DELETE CASCADE,
+    verify_token CHAR(32)       NOT NULL DEFAULT md5(gen_random_uuid()::text),
+    verified_at TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ     DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Domains registered before verification existed have to be verified by their owner
+ALTER TABLE domains
+    ADD COLUMN IF NOT EXISTS verify_token CHAR(32) NOT NULL DEFAULT md5(gen_random_uuid()::text),
+    ADD COLUMN IF NOT EXISTS verified_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS domains_owner_id_idx ON domains (owner_id, host);
+
+CREATE SEQUENCE IF NOT EXISTS slug_counter_seq;
+
 CREATE TABLE IF NOT EXISTS urls (
     id          BIGSERIAL       PRIMARY KEY,
     long_url    VARCHAR(2048)   NOT NULL,
-    slug        VARCHAR(10)     NOT NULL UNIQUE,
+    long_url_hash CHAR(64),
+    title       VARCHAR(255),
+    interstitial BOOLEAN        NOT NULL DEFAULT FALSE,
+    redirect_status SMALLINT,
+    forward_query BOOLEAN       NOT NULL DEFAULT FALSE,
+    rules       JSONB,
+    domain      VARCHAR(253)    REFERENCES domains (host),
+    slug        VARCHAR(32)     NOT NULL,
+    link_key    VARCHAR(286)    NOT NULL UNIQUE GENERATED ALWAYS AS (COALESCE(domain || '/', '') || slug) STORED,
+    owner_id    BIGINT          REFERENCES owners (id) ON DELETE CASCADE,
     clicks      BIGINT          DEFAULT 0,
+    bot_clicks  BIGINT          DEFAULT 0,
+    unique_visitors BIGINT      DEFAULT 0,
+    max_clicks  BIGINT,
+    clicks_used BIGINT          NOT NULL DEFAULT 0,
+    password_hash VARCHAR(60),
+    disabled_at TIMESTAMPTZ,
+    disabled_reason VARCHAR(255),
     created_at  TIMESTAMPTZ     DEFAULT CURRENT_TIMESTAMP,
-    expires_at  TIMESTAMPTZ     NOT NULL
-);
\ No newline at end of file
+    expires_at  TIMESTAMPTZ
+);
+
+ALTER TABLE urls
+    ADD COLUMN IF NOT EXISTS long_url_hash CHAR(64),
+    ADD COLUMN IF NOT EXISTS title VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS redirect_status SMALLINT,
+    ADD COLUMN IF NOT EXISTS forward_query BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS rules JSONB,
+    ADD COLUMN IF NOT EXISTS domain VARCHAR(253) REFERENCES domains (host),
+    ADD COLUMN IF NOT EXISTS owner_id BIGINT REFERENCES owners (id) ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS bot_clicks BIGINT DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS unique_visitors BIGINT DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS max_clicks BIGINT,
+    ADD COLUMN IF NOT EXISTS clicks_used BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS password_hash VARCHAR(60),
+    ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS disabled_reason VARCHAR(255),
+    ALTER COLUMN expires_at DROP NOT NULL;
+
+-- Slugs used to be unique on their own and at most 10 characters long, now the link key is unique.
+-- The analytics tables referenced urls (slug), their keys are moved over further down.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'urls' AND column_name = 'link_key') THEN
+        ALTER TABLE IF EXISTS clicks_hourly DROP CONSTRAINT IF EXISTS clicks_hourly_slug_fkey;
+        ALTER TABLE IF EXISTS clicks_breakdown DROP CONSTRAINT IF EXISTS clicks_breakdown_slug_fkey;
+        ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_slug_key;
+        ALTER TABLE urls ALTER COLUMN slug TYPE VARCHAR(32);
+        ALTER TABLE urls ADD COLUMN link_key VARCHAR(286) NOT NULL UNIQUE GENERATED ALWAYS AS (COALESCE(domain || '/', '') || slug) STORED;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS urls_owner_id_idx ON urls (owner_id, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS urls_owner_hash_idx ON urls (owner_id, long_url_hash);
+
+CREATE TABLE IF NOT EXISTS clicks_hourly (
+    slug        VARCHAR(286)    NOT NULL REFERENCES urls (link_key) ON DELETE CASCADE,
+    bucket      TIMESTAMPTZ     NOT NULL,
+    count       BIGINT          NOT NULL DEFAULT 0,
+    PRIMARY KEY (slug, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS clicks_breakdown (
+    slug        VARCHAR(286)    NOT NULL REFERENCES urls (link_key) ON DELETE CASCADE,
+    dimension   VARCHAR(16)     NOT NULL,
+    value       VARCHAR(255)    NOT NULL,
+    count       BIGINT          NOT NULL DEFAULT 0,
+    PRIMARY KEY (slug, dimension, value)
+);
+
+-- Link keys of old links equal their slugs, so the existing rows satisfy the new references
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'clicks_hourly_slug_fkey') THEN
+        ALTER TABLE clicks_hourly ALTER COLUMN slug TYPE VARCHAR(286);
+        ALTER TABLE clicks_hourly ADD CONSTRAINT clicks_hourly_slug_fkey FOREIGN KEY (slug) REFERENCES urls (link_key) ON DELETE CASCADE;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'clicks_breakdown_slug_fkey') THEN
+        ALTER TABLE clicks_breakdown ALTER COLUMN slug TYPE VARCHAR(286);
+        ALTER TABLE clicks_breakdown ADD CONSTRAINT clicks_breakdown_slug_fkey FOREIGN KEY (slug) REFERENCES urls (link_key) ON DELETE CASCADE;
+    END IF;
+END $$;
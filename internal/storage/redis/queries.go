@@ -2,22 +2,125 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"time"
+	"url-shortener/internal/models"
+
+	"github.com/redis/go-redis/v9"
 )
 
-func (r *RedisCache) GetUrl(ctx context.Context, slug string) (string, error) {
-	longUrl, err := r.rdb.Get(ctx, "url:"+slug).Result()
-	return longUrl, err
+// GetUrl reports an entry it can't decode as a miss, older instances cached the bare long url and
+// the lookup then overwrites the entry from postgres
+func (r *RedisCache) GetUrl(ctx context.Context, slug string) (models.UrlRecord, error) {
+	var link models.UrlRecord
+
+	data, err := r.rdb.Get(ctx, "url:"+slug).Bytes()
+
+	if err != nil {
+		return link, err
+	}
+
+	err = json.Unmarshal(data, &link)
+
+	if err != nil {
+		log.Println("Undecodable cached url, treating as a miss:", slug, err)
+		return models.UrlRecord{}, redis.Nil
+	}
+
+	return link, nil
+}
+
+func (r *RedisCache) StoreUrl(ctx context.Context, slug string, link models.UrlRecord, ttl time.Duration) error {
+	data, err := json.Marshal(link)
+
+	if err != nil {
+		return err
+	}
+
+	err = r.rdb.Set(ctx, "url:"+slug, data, ttl).Err()
+	return err
+}
+
+// ClickLimitReached tells whether a link is known to have used up its clicks, postgres keeps the count
+func (r *RedisCache) ClickLimitReached(ctx context.Context, slug string) (bool, error) {
+	n, err := r.rdb.Exists(ctx, "limit:"+slug).Result()
+	return n > 0, err
+}
+
+// SetClickLimitReached spares later clicks on a used up link the trip to postgres, a zero ttl keeps the mark
+func (r *RedisCache) SetClickLimitReached(ctx context.Context, slug string, ttl time.Duration) error {
+	err := r.rdb.Set(ctx, "limit:"+slug, 1, ttl).Err()
+	return err
+}
+
+func (r *RedisCache) GetQrCode(ctx context.Context, key string) ([]byte, error) {
+	data, err := r.rdb.Get(ctx, "qr:"+key).Bytes()
+	return data, err
 }
 
-func (r *RedisCache) StoreUrl(ctx context.Context, slug string, longUrl string) error {
-	err := r.rdb.Set(ctx, "url:"+slug, longUrl, r.Cfg.Cache.UrlExpiration).Err()
+func (r *RedisCache) StoreQrCode(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	err := r.rdb.Set(ctx, "qr:"+key, data, ttl).Err()
+	return err
+}
+
+func (r *RedisCache) DeleteUrl(ctx context.Context, slug string) error {
+	err := r.rdb.Del(ctx, "url:"+slug).Err()
+	return err
+}
+
+// PurgeUrl also drops per-link state so a reused slug starts from scratch
+func (r *RedisCache) PurgeUrl(ctx context.Context, slug string) error {
+	txpipe := r.rdb.TxPipeline()
+
+	txpipe.Del(ctx, "url:"+slug, "visitors:"+slug, "limit:"+slug)
+	txpipe.HDel(ctx, "clicks", slug)
+	txpipe.HDel(ctx, "bot_clicks", slug)
+	txpipe.SRem(ctx, "visitors:dirty", slug)
+
+	_, err := txpipe.Exec(ctx)
+
 	return err
 }
 
+// cleanUpPatterns cover the per-link state, postgres drops all links on startup and a link created
+// again under the same key must not inherit its predecessor's clicks, limit or visitors. Rate limits
+// and QR codes expire on their own.
+var cleanUpPatterns = []string{"url:*", "limit:*", "visitors:*", "clicks*", "bot_clicks*", "breakdowns*"}
+
 func (r *RedisCache) CleanUp(ctx context.Context) error {
-	err := r.rdb.FlushAll(ctx).Err()
+	var keys []string
+
+	for _, pattern := range cleanUpPatterns {
+		iter := r.rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+
+			if len(keys) == 1000 {
+				err := r.rdb.Unlink(ctx, keys...).Err()
+
+				if err != nil {
+					return err
+				}
+
+				keys = keys[:0]
+			}
+		}
+
+		err := iter.Err()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err := r.rdb.Unlink(ctx, keys...).Err()
+
 	return err
 }
 
@@ -60,6 +163,99 @@ func (r *RedisCache) IncrementBatch(ctx context.Context, key string, slugs map[s
 	return err
 }
 
+// AddVisitors adds visitor ids to the sketches of their links. Sketches expire together with their
+// link, a zero expiry means the link never expires.
+func (r *RedisCache) AddVisitors(ctx context.Context, visitors map[string][]string, expiry map[string]time.Time) error {
+	pipe := r.rdb.Pipeline()
+
+	for slug, ids := range visitors {
+		elems := make([]any, len(ids))
+
+		for i, id := range ids {
+			elems[i] = id
+		}
+
+		pipe.PFAdd(ctx, "visitors:"+slug, elems...)
+		pipe.SAdd(ctx, "visitors:dirty", slug)
+
+		expiresAt, ok := expiry[slug]
+
+		if ok && expiresAt.IsZero() {
+			pipe.Persist(ctx, "visitors:"+slug)
+		} else if ok {
+			pipe.ExpireAt(ctx, "visitors:"+slug, expiresAt)
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+func (r *RedisCache) CountVisitors(ctx context.Context, slugs ...string) (map[string]int64, error) {
+	pipe := r.rdb.Pipeline()
+
+	cmds := make(map[string]*redis.IntCmd, len(slugs))
+
+	for _, slug := range slugs {
+		cmds[slug] = pipe.PFCount(ctx, "visitors:"+slug)
+	}
+
+	_, err := pipe.Exec(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(slugs))
+
+	for slug, cmd := range cmds {
+		counts[slug] = cmd.Val()
+	}
+
+	return counts, nil
+}
+
+// claimVisitorSlugs moves the dirty set aside so clicks arriving during the flush mark a fresh one
+var claimVisitorSlugs = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {}
+end
+
+redis.call("RENAME", KEYS[1], KEYS[2])
+redis.call("PEXPIRE", KEYS[2], ARGV[1])
+
+return redis.call("SMEMBERS", KEYS[2])
+`)
+
+// ClaimVisitorSlugs returns the slugs whose visitor sketches changed since the last claim. They
+// are kept under processingKey until ReleaseVisitorSlugs.
+func (r *RedisCache) ClaimVisitorSlugs(ctx context.Context, processingKey string, ttl time.Duration) ([]string, error) {
+	slugs, err := claimVisitorSlugs.Run(ctx, r.rdb, []string{"visitors:dirty", processingKey}, ttl.Milliseconds()).StringSlice()
+	return slugs, err
+}
+
+// ReleaseVisitorSlugs drops claimed slugs once they are stored, after a failed flush they are
+// merged back into the dirty set for the next one
+func (r *RedisCache) ReleaseVisitorSlugs(ctx context.Context, processingKey string, stored bool) error {
+	txpipe := r.rdb.TxPipeline()
+
+	if !stored {
+		txpipe.SUnionStore(ctx, "visitors:dirty", "visitors:dirty", processingKey)
+	}
+
+	txpipe.Del(ctx, processingKey)
+
+	_, err := txpipe.Exec(ctx)
+
+	return err
+}
+
+func (r *RedisCache) HashGet(ctx context.Context, key string, field string) (string, error) {
+	val, err := r.rdb.HGet(ctx, key, field).Result()
+	return val, err
+}
+
 func (r *RedisCache) HashGetAll(ctx context.Context, key string) (map[string]string, error) {
 	mp, err := r.rdb.HGetAll(ctx, key).Result()
 	return mp, err
@@ -70,13 +266,95 @@ func (r *RedisCache) Delete(ctx context.Context, key string) error {
 	return err
 }
 
-func (r *RedisCache) RenameSetTTL(ctx context.Context, oldkey string, newkey string, ttl time.Duration) error {
+// startFlush moves a counter hash aside and registers it under <key>:flushing, so the counts stay
+// readable until the flush is finished
+var startFlush = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+
+redis.call("RENAME", KEYS[1], KEYS[2])
+redis.call("PEXPIRE", KEYS[2], ARGV[1])
+redis.call("SADD", KEYS[3], KEYS[2])
+redis.call("PEXPIRE", KEYS[3], ARGV[1])
+
+return 1
+`)
+
+// StartFlush reports false when there is nothing to flush
+func (r *RedisCache) StartFlush(ctx context.Context, key string, processingKey string, ttl time.Duration) (bool, error) {
+	moved, err := startFlush.Run(ctx, r.rdb, []string{key, processingKey, key + ":flushing"}, ttl.Milliseconds()).Int()
+	return moved == 1, err
+}
+
+func (r *RedisCache) FinishFlush(ctx context.Context, key string, processingKey string) error {
 	txpipe := r.rdb.TxPipeline()
 
-	txpipe.Rename(ctx, oldkey, newkey)
-	txpipe.Expire(ctx, newkey, ttl)
+	txpipe.Del(ctx, processingKey)
+	txpipe.SRem(ctx, key+":flushing", processingKey)
 
 	_, err := txpipe.Exec(ctx)
 
 	return err
 }
+
+// abortFlush adds the counts of a failed flush back onto the live hash for the next one
+var abortFlush = redis.NewScript(`
+local counts = redis.call("HGETALL", KEYS[2])
+
+for i = 1, #counts, 2 do
+	redis.call("HINCRBY", KEYS[1], counts[i], counts[i + 1])
+end
+
+redis.call("DEL", KEYS[2])
+redis.call("SREM", KEYS[3], KEYS[2])
+
+return #counts / 2
+`)
+
+func (r *RedisCache) AbortFlush(ctx context.Context, key string, processingKey string) error {
+	err := abortFlush.Run(ctx, r.rdb, []string{key, processingKey, key + ":flushing"}).Err()
+	return err
+}
+
+// PendingCount sums the field over the live counter hash and the copies of it that are being flushed
+func (r *RedisCache) PendingCount(ctx context.Context, key string, field string) (int64, error) {
+	flushing, err := r.rdb.SMembers(ctx, key+":flushing").Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	pipe := r.rdb.Pipeline()
+
+	cmds := []*redis.StringCmd{pipe.HGet(ctx, key, field)}
+
+	for _, processingKey := range flushing {
+		cmds = append(cmds, pipe.HGet(ctx, processingKey, field))
+	}
+
+	// A missing field fails the pipeline with redis.Nil, the commands are checked one by one
+	_, err = pipe.Exec(ctx)
+
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	var total int64
+
+	for _, cmd := range cmds {
+		n, err := cmd.Int64()
+
+		if err == redis.Nil {
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
@@ -2,29 +2,74 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
+	"url-shortener/internal/models"
+)
+
+var (
+	ErrSlugExists   = errors.New("slug exists")
+	ErrDomainExists = errors.New("domain exists")
+	ErrDomainInUse  = errors.New("domain has links")
 )
 
 type Database interface {
-	StoreUrl(context.Context, string, string, time.Duration) error
+	StoreUrl(context.Context, models.Url) error
+	StoreUrls(context.Context, []models.Url) (map[string]bool, error)
 	StoreClicks(context.Context, string, ...any) error
+	FindUrl(context.Context, models.Url) (models.Url, error)
+	NextSlugID(context.Context) (int64, error)
 	SlugExists(context.Context, string) (bool, error)
-	GetUrl(context.Context, string) (string, error)
+	GetUrl(context.Context, string) (models.UrlRecord, error)
+	GetUrlOwner(context.Context, string) (*int64, error)
+	ConsumeClick(context.Context, string) (int64, error)
+	ListUrls(context.Context, int64, int, int) ([]models.Url, error)
+	ExportUrls(context.Context, int64, func(models.Url) error) error
+	UpdateUrl(context.Context, string, models.UrlUpdate) (models.Url, error)
+	DeleteUrl(context.Context, string) error
+	ListActiveUrls(context.Context, int64, int) ([]models.UrlTarget, error)
+	DisableUrl(context.Context, string, string) error
+	GetStats(context.Context, string) (models.Stats, error)
+	GetClicksTimeseries(context.Context, string, string, time.Time, time.Time) ([]models.ClicksPoint, error)
+	GetBreakdown(context.Context, string, string, int) ([]models.BreakdownEntry, error)
+	CreateDomain(context.Context, int64, string) (models.Domain, error)
+	GetDomainOwner(context.Context, string) (int64, error)
+	GetDomain(context.Context, int64, string) (models.Domain, error)
+	VerifyDomain(context.Context, int64, string) error
+	ListDomains(context.Context, int64) ([]models.Domain, error)
+	DeleteDomain(context.Context, int64, string) error
+	GetOwnerByKey(context.Context, string) (int64, error)
+	CreateApiKey(context.Context, string, string) (int64, error)
+	RevokeApiKey(context.Context, string) error
 	CleanUp(context.Context) error
 	ExpireUrls(context.Context) (int64, error)
 	Close() error
 }
 
 type Cache interface {
-	GetUrl(context.Context, string) (string, error)
+	GetUrl(context.Context, string) (models.UrlRecord, error)
+	HashGet(context.Context, string, string) (string, error)
 	HashGetAll(context.Context, string) (map[string]string, error)
-	StoreUrl(context.Context, string, string) error
+	StoreUrl(context.Context, string, models.UrlRecord, time.Duration) error
+	DeleteUrl(context.Context, string) error
+	PurgeUrl(context.Context, string) error
+	ClickLimitReached(context.Context, string) (bool, error)
+	SetClickLimitReached(context.Context, string, time.Duration) error
+	GetQrCode(context.Context, string) ([]byte, error)
+	StoreQrCode(context.Context, string, []byte, time.Duration) error
 	CleanUp(context.Context) error
 	GetIP(context.Context, string) (map[string]string, error)
 	StoreIPLimit(context.Context, string, float64, float64) error
 	Increment(context.Context, string, int64) error
 	IncrementBatch(context.Context, string, map[string]int64, int) error
+	AddVisitors(context.Context, map[string][]string, map[string]time.Time) error
+	CountVisitors(context.Context, ...string) (map[string]int64, error)
+	ClaimVisitorSlugs(context.Context, string, time.Duration) ([]string, error)
+	ReleaseVisitorSlugs(context.Context, string, bool) error
 	Delete(context.Context, string) error
-	RenameSetTTL(context.Context, string, string, time.Duration) error
+	StartFlush(context.Context, string, string, time.Duration) (bool, error)
+	FinishFlush(context.Context, string, string) error
+	AbortFlush(context.Context, string, string) error
+	PendingCount(context.Context, string, string) (int64, error)
 	Close() error
 }
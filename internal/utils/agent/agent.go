@@ -0,0 +1,136 @@
+package agent_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+type Agent struct {
+	Browser string
+	OS      string
+	Device  string
+}
+
+type rule struct {
+	name     string
+	patterns []string
+}
+
+// Order matters: most user agents mention several engines, so the more specific tokens go first
+var browsers = []rule{
+	{"edge", []string{"edg/", "edge/", "edga/", "edgios/"}},
+	{"opera", []string{"opr/", "opera"}},
+	{"samsung", []string{"samsungbrowser"}},
+	{"chrome", []string{"chrome/", "crios/", "chromium/"}},
+	{"firefox", []string{"firefox/", "fxios/"}},
+	{"safari", []string{"safari/"}},
+	{"ie", []string{"msie", "trident/"}},
+}
+
+var systems = []rule{
+	{"windows", []string{"windows"}},
+	{"ios", []string{"iphone", "ipad", "ipod"}},
+	{"android", []string{"android"}},
+	{"chromeos", []string{"cros "}},
+	{"macos", []string{"macintosh", "mac os x"}},
+	{"linux", []string{"linux", "x11"}},
+}
+
+// botPatterns are always treated as bots, configured patterns are added to them. A bare "bot" would
+// also hit handsets such as CUBOT, so it only counts next to the punctuation bot names end in.
+var botPatterns = []string{"bot/", "bot;", "bot)", "bot-", "-bot", "slackbot", "+http", "crawl", "spider", "slurp", "preview",
+	"facebookexternalhit", "whatsapp", "embedly", "curl/", "wget/", "python-requests", "go-http-client"}
+
+var mobilePatterns = []string{"mobi", "iphone", "ipad", "ipod", "android", "tablet"}
+
+// Devices are the device classes Parse reports for a known user agent
+var Devices = []string{"mobile", "desktop"}
+
+// Systems lists the OS names Parse reports for a known user agent
+func Systems() []string {
+	names := make([]string, 0, len(systems)+1)
+
+	for _, r := range systems {
+		names = append(names, r.name)
+	}
+
+	return append(names, "other")
+}
+
+func Parse(userAgent string) Agent {
+	if userAgent == "" {
+		return Agent{
+			Browser: "unknown",
+			OS:      "unknown",
+			Device:  "unknown",
+		}
+	}
+
+	ua := strings.ToLower(userAgent)
+
+	return Agent{
+		Browser: match(ua, browsers),
+		OS:      match(ua, systems),
+		Device:  device(ua),
+	}
+}
+
+func match(ua string, rules []rule) string {
+	for _, r := range rules {
+		if containsAny(ua, r.patterns) {
+			return r.name
+		}
+	}
+
+	return "other"
+}
+
+func device(ua string) string {
+	if containsAny(ua, mobilePatterns) {
+		return "mobile"
+	}
+
+	return "desktop"
+}
+
+// BotClassifier tags crawlers, link preview fetchers and uptime checkers by user agent substrings
+type BotClassifier struct {
+	patterns []string
+}
+
+// NewBotClassifier extends the built-in patterns with extra ones
+func NewBotClassifier(extra []string) *BotClassifier {
+	b := &BotClassifier{patterns: slices.Clone(botPatterns)}
+
+	for _, p := range extra {
+		p = strings.ToLower(strings.TrimSpace(p))
+
+		if p != "" {
+			b.patterns = append(b.patterns, p)
+		}
+	}
+
+	return b
+}
+
+func (b *BotClassifier) IsBot(userAgent string) bool {
+	return containsAny(strings.ToLower(userAgent), b.patterns)
+}
+
+// VisitorID identifies a visitor for unique counting without keeping the raw address around
+func VisitorID(ip string, userAgent string) string {
+	sum := sha256.Sum256([]byte(ip + "|" + userAgent))
+	return hex.EncodeToString(sum[:16])
+}
+
+func containsAny(s string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.Contains(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package geo_utils
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Locator looks up the country of client addresses in a local MaxMind database, Country and City
+// databases both work. A nil Locator knows no countries.
+type Locator struct {
+	db *geoip2.Reader
+}
+
+// NewLocator opens the database at path, without a path geo lookups are disabled
+func NewLocator(path string) (*Locator, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	db, err := geoip2.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Locator{db: db}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of ip, "" when the address is not in the database
+func (l *Locator) Country(ip string) string {
+	if l == nil {
+		return ""
+	}
+
+	addr := net.ParseIP(ip)
+
+	if addr == nil {
+		return ""
+	}
+
+	record, err := l.db.Country(addr)
+
+	if err != nil {
+		return ""
+	}
+
+	return record.Country.IsoCode
+}
+
+func (l *Locator) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.db.Close()
+}
@@ -0,0 +1,109 @@
+package url_utils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"url-shortener/internal/config"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Domains maps request hosts to the domain links are stored under and builds short urls.
+// The base url's host and its aliases make up the default domain, which is stored as "".
+type Domains struct {
+	base    *url.URL
+	aliases map[string]struct{}
+}
+
+func NewDomains(cfg config.ServerConfig) (*Domains, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.BaseUrl, "/"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, errors.New("base url needs an http or https scheme and a host")
+	}
+
+	d := &Domains{
+		base:    base,
+		aliases: map[string]struct{}{NormalizeHost(base.Host): {}},
+	}
+
+	for _, alias := range cfg.AliasDomains {
+		d.aliases[NormalizeHost(alias)] = struct{}{}
+	}
+
+	return d, nil
+}
+
+// Resolve returns the domain a request host or a requested domain stands for
+func (d *Domains) Resolve(host string) string {
+	host = NormalizeHost(host)
+
+	if _, ok := d.aliases[host]; ok {
+		return ""
+	}
+
+	return host
+}
+
+// IsDefault reports whether host serves the default domain
+func (d *Domains) IsDefault(host string) bool {
+	return d.Resolve(host) == ""
+}
+
+// ShortUrl joins the domain and path, branded domains share the scheme of the base url
+func (d *Domains) ShortUrl(domain string, path string) string {
+	if domain == "" {
+		return d.base.String() + "/" + path
+	}
+
+	return d.base.Scheme + "://" + domain + "/" + path
+}
+
+// LinkKey identifies a link across domains: the bare slug on the default domain and
+// domain/slug on a branded one. Cache entries, click counters and analytics use it.
+func LinkKey(domain string, slug string) string {
+	if domain == "" {
+		return slug
+	}
+
+	return domain + "/" + slug
+}
+
+// NormalizeHost lowercases a host and drops the port and trailing dot
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(host, ".")
+}
+
+// VerifyRecord is the name of the TXT record an owner publishes to verify host
+func VerifyRecord(host string) string {
+	return "_shortener-verify." + host
+}
+
+// VerifyValue is the content the verification TXT record must have
+func VerifyValue(token string) string {
+	return "shortener-verify=" + token
+}
+
+func ValidateDomain(host string) error {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+
+	var validateDomain struct {
+		Host string `validate:"required,max=253,fqdn"`
+	}
+
+	validateDomain.Host = host
+
+	return validate.Struct(validateDomain)
+}
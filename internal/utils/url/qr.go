@@ -0,0 +1,224 @@
+package url_utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	QrFormatPng = "png"
+	QrFormatSvg = "svg"
+
+	minQrSize   = 64
+	maxQrSize   = 2048
+	maxQrBorder = 16
+)
+
+// cachedQrSizes are the sizes worth keeping in redis
+var cachedQrSizes = []int{128, 256, 512, 1024}
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// QrOptions controls how a QR code is rendered. Size is the image width in pixels, Border the
+// quiet zone in modules and the colors are hex rrggbb values.
+type QrOptions struct {
+	Size       int
+	Level      string
+	Foreground string
+	Background string
+	Border     int
+	Format     string
+}
+
+// DefaultQrOptions renders the 256px black on white PNG the endpoint always served
+func DefaultQrOptions() QrOptions {
+	return QrOptions{
+		Size:       256,
+		Level:      "M",
+		Foreground: "000000",
+		Background: "ffffff",
+		Border:     4,
+		Format:     QrFormatPng,
+	}
+}
+
+// Normalize brings equivalent spellings to one form so they share a cache entry
+func (o *QrOptions) Normalize() {
+	o.Level = strings.ToUpper(o.Level)
+	o.Format = strings.ToLower(o.Format)
+	o.Foreground = strings.ToLower(strings.TrimPrefix(o.Foreground, "#"))
+	o.Background = strings.ToLower(strings.TrimPrefix(o.Background, "#"))
+}
+
+func (o QrOptions) Validate() error {
+	if o.Size < minQrSize || o.Size > maxQrSize {
+		return fmt.Errorf("size must be between %d and %d", minQrSize, maxQrSize)
+	}
+
+	if _, ok := qrLevels[o.Level]; !ok {
+		return errors.New("level must be one of L, M, Q, H")
+	}
+
+	if o.Border < 0 || o.Border > maxQrBorder {
+		return fmt.Errorf("border must be between 0 and %d", maxQrBorder)
+	}
+
+	if o.Format != QrFormatPng && o.Format != QrFormatSvg {
+		return errors.New("format must be png or svg")
+	}
+
+	fg, err := parseHexColor(o.Foreground)
+
+	if err != nil {
+		return errors.New("invalid fg: " + err.Error())
+	}
+
+	bg, err := parseHexColor(o.Background)
+
+	if err != nil {
+		return errors.New("invalid bg: " + err.Error())
+	}
+
+	if fg == bg {
+		return errors.New("fg and bg must differ")
+	}
+
+	return nil
+}
+
+func (o QrOptions) ContentType() string {
+	if o.Format == QrFormatSvg {
+		return "image/svg+xml"
+	}
+
+	return "image/png"
+}
+
+// Cacheable tells whether a rendering is worth keeping in redis. Only the default colors and border
+// in a few common sizes are, so arbitrary options can't grow the cache without bound.
+func (o QrOptions) Cacheable() bool {
+	def := DefaultQrOptions()
+
+	return o.Foreground == def.Foreground && o.Background == def.Background && o.Border == def.Border && slices.Contains(cachedQrSizes, o.Size)
+}
+
+// CacheKey identifies a rendering of content with these options
+func (o QrOptions) CacheKey(content string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s|%s|%s|%d|%s", content, o.Size, o.Level, o.Foreground, o.Background, o.Border, o.Format)))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateQrCode renders content with validated options
+func GenerateQrCode(content string, opts QrOptions) ([]byte, error) {
+	q, err := qrcode.New(content, qrLevels[opts.Level])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The quiet zone is added below so its width can be chosen
+	q.DisableBorder = true
+	modules := q.Bitmap()
+
+	fg, _ := parseHexColor(opts.Foreground)
+	bg, _ := parseHexColor(opts.Background)
+
+	if opts.Format == QrFormatSvg {
+		return qrSvg(modules, opts, fg, bg), nil
+	}
+
+	return qrPng(modules, opts, fg, bg)
+}
+
+// qrPng maps every pixel to its nearest module the way go-qrcode does, the image is never
+// smaller than one pixel per module
+func qrPng(modules [][]bool, opts QrOptions, fg color.RGBA, bg color.RGBA) ([]byte, error) {
+	total := len(modules) + 2*opts.Border
+	size := max(opts.Size, total)
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{bg, fg})
+	modulesPerPixel := float64(total) / float64(size)
+
+	for y := 0; y < size; y++ {
+		my := int(float64(y)*modulesPerPixel) - opts.Border
+
+		for x := 0; x < size; x++ {
+			mx := int(float64(x)*modulesPerPixel) - opts.Border
+
+			if my >= 0 && my < len(modules) && mx >= 0 && mx < len(modules) && modules[my][mx] {
+				img.Pix[img.PixOffset(x, y)] = 1
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, img)
+
+	return buf.Bytes(), err
+}
+
+// qrSvg draws one module per user unit and lets the viewer scale it, dark runs of a row become one path segment
+func qrSvg(modules [][]bool, opts QrOptions, fg color.RGBA, bg color.RGBA) []byte {
+	total := len(modules) + 2*opts.Border
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, opts.Size, opts.Size, total, total)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, total, total, hexColor(bg))
+	fmt.Fprintf(&buf, `<path fill="%s" d="`, hexColor(fg))
+
+	for y, row := range modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+
+			start := x
+
+			for x < len(row) && row[x] {
+				x++
+			}
+
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", start+opts.Border, y+opts.Border, x-start, x-start)
+		}
+	}
+
+	buf.WriteString(`"/></svg>`)
+
+	return buf.Bytes()
+}
+
+func parseHexColor(s string) (color.RGBA, error) {
+	if len(s) != 6 {
+		return color.RGBA{}, errors.New("expected 6 hex digits")
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+
+	if err != nil {
+		return color.RGBA{}, errors.New("expected 6 hex digits")
+	}
+
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
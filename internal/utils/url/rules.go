@@ -0,0 +1,141 @@
+package url_utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"url-shortener/internal/models"
+	"url-shortener/internal/utils/agent"
+)
+
+const maxRedirectRules = 20
+
+var (
+	countryPattern  = regexp.MustCompile(`^[A-Z]{2}$`)
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+)
+
+// Visitor is what redirect rules are matched against
+type Visitor struct {
+	Country  string
+	Language string
+	OS       string
+	Device   string
+}
+
+// NormalizeRules validates redirect rules and brings their conditions to the form they are
+// matched in: upper case countries and lower case languages, systems and devices
+func NormalizeRules(rules []models.RedirectRule) error {
+	if len(rules) > maxRedirectRules {
+		return fmt.Errorf("a link can't have more than %d rules", maxRedirectRules)
+	}
+
+	for i := range rules {
+		r := &rules[i]
+
+		r.Country = strings.ToUpper(strings.TrimSpace(r.Country))
+		r.Language = strings.ToLower(strings.TrimSpace(r.Language))
+		r.OS = strings.ToLower(strings.TrimSpace(r.OS))
+		r.Device = strings.ToLower(strings.TrimSpace(r.Device))
+
+		err := validateRule(*r)
+
+		if err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validateRule(r models.RedirectRule) error {
+	if r.Country == "" && r.Language == "" && r.OS == "" && r.Device == "" {
+		return errors.New("at least one of country, language, os and device must be set")
+	}
+
+	if r.Country != "" && !countryPattern.MatchString(r.Country) {
+		return errors.New("country must be a two letter ISO code")
+	}
+
+	if r.Language != "" && !languagePattern.MatchString(r.Language) {
+		return errors.New("language must be a language tag such as en or pt-br")
+	}
+
+	if systems := agent_utils.Systems(); r.OS != "" && !slices.Contains(systems, r.OS) {
+		return errors.New("os must be one of " + strings.Join(systems, ", "))
+	}
+
+	if r.Device != "" && !slices.Contains(agent_utils.Devices, r.Device) {
+		return errors.New("device must be one of " + strings.Join(agent_utils.Devices, ", "))
+	}
+
+	err := ValidateUrl(r.Url)
+
+	if err != nil {
+		return errors.New("invalid url: " + err.Error())
+	}
+
+	return nil
+}
+
+// MatchRule returns the destination of the first rule the visitor matches. A language condition
+// matches its subtags too, en matches en-us.
+func MatchRule(rules []models.RedirectRule, v Visitor) (string, bool) {
+	for _, r := range rules {
+		if r.Country != "" && r.Country != v.Country {
+			continue
+		}
+
+		if r.Language != "" && v.Language != r.Language && !strings.HasPrefix(v.Language, r.Language+"-") {
+			continue
+		}
+
+		if r.OS != "" && r.OS != v.OS {
+			continue
+		}
+
+		if r.Device != "" && r.Device != v.Device {
+			continue
+		}
+
+		return r.Url, true
+	}
+
+	return "", false
+}
+
+// PreferredLanguage returns the lower cased tag an Accept-Language header ranks highest,
+// ties go to the tag listed first. Wildcards and malformed weights are ignored.
+func PreferredLanguage(header string) string {
+	best, bestWeight := "", 0.0
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		weight := 1.0
+
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+
+			if err != nil {
+				continue
+			}
+
+			weight = w
+		}
+
+		if weight > bestWeight {
+			best, bestWeight = tag, weight
+		}
+	}
+
+	return best
+}
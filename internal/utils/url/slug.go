@@ -0,0 +1,298 @@
+package url_utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"url-shortener/internal/config"
+)
+
+const (
+	StrategyRandom  = "random"
+	StrategyCounter = "counter"
+	StrategyWords   = "words"
+
+	// Slug columns are VARCHAR(32)
+	maxSlugLength = 32
+
+	slugSeparators = "-_"
+	urlSafe        = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789" + slugSeparators
+)
+
+type SlugGenerator interface {
+	Generate(ctx context.Context) (string, error)
+}
+
+// reservedSlugs are taken by the service's own routes, a link under one of them could never be reached
+var reservedSlugs = []string{"ping", "shorten", "api", "qr"}
+
+// NewSlugGenerator checks the slug settings once at startup and returns the configured strategy.
+// next hands out unique numbers for the counter strategy and is unused otherwise.
+func NewSlugGenerator(cfg config.SlugConfig, next func(context.Context) (int64, error)) (SlugGenerator, error) {
+	if cfg.AliasMinLength < 1 || cfg.AliasMinLength > cfg.AliasMaxLength || cfg.AliasMaxLength > maxSlugLength {
+		return nil, fmt.Errorf("alias length bounds must satisfy 1 <= min <= max <= %d", maxSlugLength)
+	}
+
+	if cfg.Length < cfg.AliasMinLength || cfg.Length > cfg.AliasMaxLength {
+		return nil, errors.New("slug length must be within the alias length bounds")
+	}
+
+	if cfg.MaxAttempts < 1 {
+		return nil, errors.New("slug max attempts must be at least 1")
+	}
+
+	if len(cfg.Alphabet) < 16 {
+		return nil, errors.New("slug alphabet needs at least 16 characters")
+	}
+
+	for i := range cfg.Alphabet {
+		if !strings.ContainsRune(urlSafe, rune(cfg.Alphabet[i])) {
+			return nil, errors.New("slug alphabet may only contain letters, digits, - and _")
+		}
+
+		if strings.IndexByte(cfg.Alphabet, cfg.Alphabet[i]) != i {
+			return nil, errors.New("slug alphabet has duplicate characters")
+		}
+	}
+
+	switch cfg.Strategy {
+	case StrategyRandom:
+		return skipReserved{&randomGenerator{alphabet: cfg.Alphabet, length: cfg.Length}}, nil
+	case StrategyCounter:
+		return skipReserved{newCounterGenerator(cfg, next)}, nil
+	case StrategyWords:
+		for _, c := range "abcdefghijklmnopqrstuvwxyz" {
+			if !strings.ContainsRune(cfg.Alphabet, c) {
+				return nil, errors.New("words strategy needs lowercase letters in the slug alphabet")
+			}
+		}
+
+		if longestPair() > cfg.AliasMaxLength {
+			return nil, errors.New("word pairs don't fit into the alias max length")
+		}
+
+		return skipReserved{&wordsGenerator{}}, nil
+	}
+
+	return nil, errors.New("unknown slug strategy: " + cfg.Strategy)
+}
+
+// ValidateSlug accepts anything the configured generator could produce as well as custom aliases
+func ValidateSlug(slug string, cfg config.SlugConfig) error {
+	if len(slug) < cfg.AliasMinLength || len(slug) > cfg.AliasMaxLength {
+		return fmt.Errorf("slug length must be between %d and %d", cfg.AliasMinLength, cfg.AliasMaxLength)
+	}
+
+	for i := range slug {
+		if !strings.ContainsRune(cfg.Alphabet+slugSeparators, rune(slug[i])) {
+			return errors.New("invalid slug format: " + string(slug[i]))
+		}
+	}
+
+	if slices.Contains(reservedSlugs, slug) {
+		return errors.New("slug is reserved: " + slug)
+	}
+
+	return nil
+}
+
+// skipReserved draws again whenever the wrapped generator comes up with a reserved slug
+type skipReserved struct {
+	SlugGenerator
+}
+
+func (g skipReserved) Generate(ctx context.Context) (string, error) {
+	for {
+		slug, err := g.SlugGenerator.Generate(ctx)
+
+		if err != nil || !slices.Contains(reservedSlugs, slug) {
+			return slug, err
+		}
+	}
+}
+
+type randomGenerator struct {
+	alphabet string
+	length   int
+}
+
+func (g *randomGenerator) Generate(ctx context.Context) (string, error) {
+	slug := make([]byte, g.length)
+
+	for i := range slug {
+		a, err := rand.Int(rand.Reader, big.NewInt(int64(len(g.alphabet))))
+
+		if err != nil {
+			return "", err
+		}
+
+		slug[i] = g.alphabet[a.Int64()]
+	}
+
+	return string(slug), nil
+}
+
+// counterGenerator turns sequential ids into short unique slugs that don't look sequential.
+// Ids below alphabet^length are permuted within that range by a salted affine map, which is a
+// bijection because the multiplier is a prime larger than the alphabet, and then written with a
+// Hashids-style salted alphabet. Larger ids are written as is and come out one character longer.
+type counterGenerator struct {
+	next     func(context.Context) (int64, error)
+	alphabet []byte
+	space    *big.Int
+	offset   *big.Int
+	length   int
+	max      int
+}
+
+var counterMultiplier = big.NewInt(1_000_000_007)
+
+func newCounterGenerator(cfg config.SlugConfig, next func(context.Context) (int64, error)) *counterGenerator {
+	space := new(big.Int).Exp(big.NewInt(int64(len(cfg.Alphabet))), big.NewInt(int64(cfg.Length)), nil)
+
+	sum := sha256.Sum256([]byte(cfg.Salt))
+	offset := new(big.Int).SetBytes(sum[:])
+
+	return &counterGenerator{
+		next:     next,
+		alphabet: consistentShuffle([]byte(cfg.Alphabet), []byte(cfg.Salt)),
+		space:    space,
+		offset:   offset.Mod(offset, space),
+		length:   cfg.Length,
+		max:      cfg.AliasMaxLength,
+	}
+}
+
+func (g *counterGenerator) Generate(ctx context.Context) (string, error) {
+	id, err := g.next(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	if id < 0 {
+		return "", errors.New("negative slug id")
+	}
+
+	n := big.NewInt(id)
+	length := 0
+
+	if n.Cmp(g.space) < 0 {
+		n.Mul(n, counterMultiplier)
+		n.Add(n, g.offset)
+		n.Mod(n, g.space)
+		length = g.length
+	}
+
+	base := big.NewInt(int64(len(g.alphabet)))
+	digit := new(big.Int)
+
+	var slug []byte
+
+	for n.Sign() > 0 || len(slug) < length {
+		n.DivMod(n, base, digit)
+		slug = append(slug, g.alphabet[digit.Int64()])
+	}
+
+	slices.Reverse(slug)
+
+	if len(slug) > g.max {
+		return "", errors.New("slug counter outgrew the alias max length")
+	}
+
+	return string(slug), nil
+}
+
+// consistentShuffle is the Hashids shuffle, the same salt always gives the same order
+func consistentShuffle(alphabet []byte, salt []byte) []byte {
+	result := make([]byte, len(alphabet))
+	copy(result, alphabet)
+
+	if len(salt) == 0 {
+		return result
+	}
+
+	for i, v, p := len(result)-1, 0, 0; i > 0; i-- {
+		v %= len(salt)
+		p += int(salt[v])
+		j := (int(salt[v]) + v + p) % i
+
+		result[i], result[j] = result[j], result[i]
+		v++
+	}
+
+	return result
+}
+
+type wordsGenerator struct{}
+
+func (g *wordsGenerator) Generate(ctx context.Context) (string, error) {
+	adjective, err := rand.Int(rand.Reader, big.NewInt(int64(len(adjectives))))
+
+	if err != nil {
+		return "", err
+	}
+
+	noun, err := rand.Int(rand.Reader, big.NewInt(int64(len(nouns))))
+
+	if err != nil {
+		return "", err
+	}
+
+	return adjectives[adjective.Int64()] + "-" + nouns[noun.Int64()], nil
+}
+
+func longestPair() int {
+	longest := 0
+
+	for _, a := range adjectives {
+		for _, n := range nouns {
+			longest = max(longest, len(a)+1+len(n))
+		}
+	}
+
+	return longest
+}
+
+var adjectives = []string{
+	"able", "amber", "ancient", "arctic", "azure", "bold", "brave", "breezy",
+	"bright", "brisk", "calm", "candid", "clever", "cosmic", "crimson", "crisp",
+	"curious", "daring", "dawn", "deep", "eager", "early", "easy", "electric",
+	"elegant", "epic", "fair", "fancy", "fast", "fearless", "fierce", "fluffy",
+	"fresh", "friendly", "frosty", "gentle", "giant", "gilded", "glad", "golden",
+	"graceful", "grand", "green", "happy", "hidden", "honest", "humble", "icy",
+	"jolly", "keen", "kind", "lively", "lucky", "lunar", "magic", "mellow",
+	"merry", "mighty", "misty", "modern", "noble", "nimble", "odd", "olive",
+	"patient", "plain", "polite", "proud", "quick", "quiet", "rapid", "rare",
+	"ready", "red", "robust", "rosy", "royal", "rustic", "sandy", "scarlet",
+	"secret", "serene", "shiny", "silent", "silver", "simple", "sleek", "smart",
+	"smooth", "snowy", "solar", "solid", "sonic", "spicy", "steady", "stormy",
+	"sturdy", "sunny", "super", "swift", "tall", "tame", "tidy", "tiny",
+	"tropical", "true", "urban", "valiant", "velvet", "vivid", "warm", "wild",
+	"wise", "witty", "wooden", "young", "zany", "zesty", "agile", "bouncy",
+	"cheery", "dusky", "fuzzy", "hardy", "jazzy", "mossy", "plucky", "rugged",
+}
+
+var nouns = []string{
+	"acorn", "anchor", "apple", "arrow", "badger", "bay", "beacon", "bear",
+	"beaver", "bison", "breeze", "brook", "cactus", "canyon", "castle", "cedar",
+	"cloud", "comet", "coral", "crane", "creek", "dawn", "delta", "dolphin",
+	"dove", "dragon", "dune", "eagle", "echo", "falcon", "fern", "finch",
+	"fjord", "flame", "forest", "fox", "garden", "gecko", "glacier", "grove",
+	"harbor", "hawk", "heron", "hill", "horizon", "island", "ivy", "jaguar",
+	"jungle", "koala", "lagoon", "lake", "lantern", "lemur", "lion", "lotus",
+	"lynx", "maple", "marsh", "meadow", "mesa", "meteor", "moon", "moose",
+	"needle", "nebula", "oak", "ocean", "orbit", "orchid", "otter", "owl",
+	"panda", "parrot", "peak", "pebble", "pine", "planet", "pond", "prairie",
+	"puffin", "quartz", "rabbit", "raven", "reef", "ridge", "river", "robin",
+	"rocket", "sail", "salmon", "sparrow", "spruce", "star", "stone", "summit",
+	"swan", "tiger", "thunder", "tulip", "valley", "violet", "volcano", "walrus",
+	"wave", "willow", "wolf", "wren", "yak", "zebra", "acacia", "aurora",
+	"basil", "birch", "boulder", "cobra", "cougar", "cricket", "daisy", "ember",
+	"ferret", "galaxy", "hazel", "iris", "kestrel", "magpie", "mango", "nectar",
+}
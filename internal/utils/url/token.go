@@ -0,0 +1,68 @@
+package url_utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContinueTokens signs the continue links of interstitials and unlocked links, so the pages in
+// front of a redirect can't be skipped by crafting the url. A token is bound to one link and
+// expires after ttl.
+type ContinueTokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewContinueTokens signs with secret, instances behind one load balancer need the same one.
+// Without a secret a random one is used, tokens then only hold on this instance until it restarts.
+func NewContinueTokens(secret string, ttl time.Duration) (*ContinueTokens, error) {
+	key := []byte(secret)
+
+	if secret == "" {
+		key = make([]byte, 32)
+
+		_, err := rand.Read(key)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ContinueTokens{secret: key, ttl: ttl}, nil
+}
+
+// Issue returns a token for the link stored under key
+func (t *ContinueTokens) Issue(key string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(t.ttl).Unix(), 36)
+
+	return expires + "." + t.sign(key, expires)
+}
+
+// Valid tells whether token was issued for key and has not expired yet
+func (t *ContinueTokens) Valid(key string, token string, now time.Time) bool {
+	expires, sig, ok := strings.Cut(token, ".")
+
+	if !ok {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(expires, 36, 64)
+
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(t.sign(key, expires)))
+}
+
+func (t *ContinueTokens) sign(key string, expires string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(key + "|" + expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
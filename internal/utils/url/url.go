@@ -1,38 +1,23 @@
 package url_utils
 
 import (
-	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/big"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"url-shortener/internal/models"
 
 	"github.com/go-playground/validator/v10"
-	qrcode "github.com/skip2/go-qrcode"
+	"github.com/lib/pq"
 )
 
-const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-func GenerateSlug(len int) (string, error) {
-	slug := make([]byte, len)
-
-	for i := range slug {
-		a, err := rand.Int(rand.Reader, big.NewInt(62))
-
-		if err != nil {
-			return "", err
-		}
-
-		slug[i] = alphabet[a.Int64()]
-	}
-
-	return string(slug), nil
-}
-
 func ValidateUrl(rawUrl string) error {
 	validate := validator.New(validator.WithRequiredStructEnabled())
 
@@ -58,25 +43,181 @@ func ValidateUrl(rawUrl string) error {
 		return errors.New("invalid url")
 	}
 
-	if strings.HasPrefix(rawUrl, "localhost:8080/") {
-		return errors.New("invalid url")
+	return nil
+}
+
+// ResolveExpiration turns the mutually exclusive expires_at, ttl and permanent options into
+// an expiry time, nil meaning the link never expires. Without any option def is used.
+func ResolveExpiration(now time.Time, expiresAt *time.Time, ttl string, permanent bool, def time.Duration, max time.Duration) (*time.Time, error) {
+	set := 0
+
+	for _, ok := range []bool{expiresAt != nil, ttl != "", permanent} {
+		if ok {
+			set++
+		}
 	}
 
-	return nil
+	if set > 1 {
+		return nil, errors.New("only one of expires_at, ttl and permanent can be set")
+	}
+
+	if permanent {
+		return nil, nil
+	}
+
+	lifetime := def
+
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+
+		if err != nil {
+			return nil, errors.New("invalid ttl: " + err.Error())
+		}
+
+		lifetime = d
+	}
+
+	if expiresAt != nil {
+		lifetime = expiresAt.Sub(now)
+	}
+
+	if lifetime <= 0 {
+		return nil, errors.New("expiration must be in the future")
+	}
+
+	if lifetime > max {
+		return nil, errors.New("expiration exceeds the maximum of " + max.String())
+	}
+
+	expires := now.Add(lifetime)
+
+	return &expires, nil
 }
 
-func ValidateSlug(slug string) error {
-	if len(slug) != 7 {
-		return errors.New("invalid slug length")
+// CanonicalizeUrl normalizes the parts of a url that don't change where it points:
+// scheme and host case, default ports, an empty path and the order of query parameters
+func CanonicalizeUrl(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		return "", err
 	}
 
-	for i := range slug {
-		if !strings.Contains(alphabet, string(slug[i])) {
-			return errors.New("invalid slug format: " + string(slug[i]))
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	u.Host = host
+
+	if port != "" {
+		u.Host += ":" + port
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	// Encode sorts by key and keeps the order of repeated keys
+	u.RawQuery = u.Query().Encode()
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+// SetUtm sets the given campaign parameters on the url, replacing values it already had for them.
+// The rest of the query is left untouched so its encoding survives, like in ForwardQuery.
+func SetUtm(rawUrl string, utm models.Utm) (string, error) {
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	set := url.Values{}
+
+	for key, value := range map[string]string{
+		"utm_source":   utm.Source,
+		"utm_medium":   utm.Medium,
+		"utm_campaign": utm.Campaign,
+		"utm_term":     utm.Term,
+		"utm_content":  utm.Content,
+	} {
+		if value != "" {
+			set.Set(key, value)
 		}
 	}
 
-	return nil
+	if len(set) == 0 {
+		return rawUrl, nil
+	}
+
+	var kept []string
+
+	if u.RawQuery != "" {
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			rawKey, _, _ := strings.Cut(pair, "=")
+
+			if key, err := url.QueryUnescape(rawKey); err == nil && set.Has(key) {
+				continue
+			}
+
+			kept = append(kept, pair)
+		}
+	}
+
+	u.RawQuery = strings.Join(append(kept, set.Encode()), "&")
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+// ForwardQuery adds the incoming query parameters to the target at redirect time. Parameters the
+// target already has keep their values, skip lists parameters that are never forwarded. The
+// target's own query is left untouched so its encoding survives.
+func ForwardQuery(target string, incoming url.Values, skip []string) string {
+	u, err := url.Parse(target)
+
+	if err != nil {
+		return target
+	}
+
+	existing := u.Query()
+	forward := url.Values{}
+
+	for key, values := range incoming {
+		if slices.Contains(skip, key) || existing.Has(key) {
+			continue
+		}
+
+		forward[key] = values
+	}
+
+	if len(forward) == 0 {
+		return target
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+
+	u.RawQuery += forward.Encode()
+	u.ForceQuery = false
+
+	return u.String()
+}
+
+func HashUrl(canonicalUrl string) string {
+	sum := sha256.Sum256([]byte(canonicalUrl))
+	return hex.EncodeToString(sum[:])
 }
 
 func GetIP(r *http.Request) string {
@@ -90,12 +231,18 @@ func GetIP(r *http.Request) string {
 	return host
 }
 
-func GenerateQrCode(shortUrl string) ([]byte, error) {
-	var data []byte
+func ReferrerHost(referrer string) string {
+	if referrer == "" {
+		return "direct"
+	}
 
-	data, err := qrcode.Encode(shortUrl, qrcode.Medium, 256)
+	u, err := url.Parse(referrer)
 
-	return data, err
+	if err != nil || u.Hostname() == "" || len(u.Hostname()) > 253 {
+		return "unknown"
+	}
+
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
 }
 
 func BuildClicksArgs(clicks map[string]int64) (string, []any) {
@@ -114,11 +261,127 @@ func BuildClicksArgs(clicks map[string]int64) (string, []any) {
 	}
 
 	query = strings.TrimSuffix(query, ",")
-	query += ") AS data(slug, added) WHERE urls.slug = data.slug"
+	query += ") AS data(slug, added) WHERE urls.link_key = data.slug"
+
+	return query, args
+}
+
+// HourlyKey is the counter field of the clicks of a link in the hour starting at bucket
+func HourlyKey(key string, bucket time.Time) string {
+	return key + "|" + strconv.FormatInt(bucket.Unix(), 10)
+}
+
+// BuildHourlyArgs expects keys in the form "slug|unix hour" as written by HourlyKey. The rows are
+// passed as arrays, a VALUES list would run into the parameter limit on busy intervals.
+func BuildHourlyArgs(counts map[string]int64) (string, []any) {
+	var slugs []string
+	var buckets, added []int64
+
+	for k, v := range counts {
+		slug, rawBucket, ok := strings.Cut(k, "|")
+
+		if !ok {
+			continue
+		}
+
+		bucket, err := strconv.ParseInt(rawBucket, 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		slugs = append(slugs, slug)
+		buckets = append(buckets, bucket)
+		added = append(added, v)
+	}
+
+	if len(slugs) == 0 {
+		return "", nil
+	}
+
+	query := `INSERT INTO clicks_hourly (slug, bucket, count)
+		SELECT data.slug, to_timestamp(data.bucket), data.added
+		FROM unnest($1::text[], $2::bigint[], $3::bigint[]) AS data(slug, bucket, added)
+		WHERE EXISTS (SELECT 1 FROM urls WHERE urls.link_key = data.slug)
+		ON CONFLICT (slug, bucket) DO UPDATE SET count = clicks_hourly.count + EXCLUDED.count`
+
+	return query, []any{pq.Array(slugs), pq.Array(buckets), pq.Array(added)}
+}
+
+func BuildBotClicksArgs(clicks map[string]int64) (string, []any) {
+	query := "UPDATE urls SET bot_clicks = urls.bot_clicks + data.added FROM (VALUES "
+	args := []any{}
+	argCounter := 0
+	argStr := ""
+
+	for k, v := range clicks {
+		argStr = fmt.Sprintf("($%d, $%d::bigint),", argCounter+1, argCounter+2)
+		query += argStr
+
+		args = append(args, k, v)
+
+		argCounter += 2
+	}
+
+	query = strings.TrimSuffix(query, ",")
+	query += ") AS data(slug, added) WHERE urls.link_key = data.slug"
 
 	return query, args
 }
 
+func BuildVisitorsArgs(visitors map[string]int64) (string, []any) {
+	query := "UPDATE urls SET unique_visitors = GREATEST(urls.unique_visitors, data.visitors) FROM (VALUES "
+	args := []any{}
+	argCounter := 0
+	argStr := ""
+
+	for k, v := range visitors {
+		argStr = fmt.Sprintf("($%d, $%d::bigint),", argCounter+1, argCounter+2)
+		query += argStr
+
+		args = append(args, k, v)
+
+		argCounter += 2
+	}
+
+	query = strings.TrimSuffix(query, ",")
+	query += ") AS data(slug, visitors) WHERE urls.link_key = data.slug"
+
+	return query, args
+}
+
+// BuildBreakdownArgs expects keys in the form "slug|dimension|value" as written by the consumer,
+// the rows are passed as arrays like in BuildHourlyArgs
+func BuildBreakdownArgs(counts map[string]int64) (string, []any) {
+	var slugs, dimensions, values []string
+	var added []int64
+
+	for k, v := range counts {
+		parts := strings.SplitN(k, "|", 3)
+
+		if len(parts) != 3 {
+			continue
+		}
+
+		slugs = append(slugs, parts[0])
+		dimensions = append(dimensions, parts[1])
+		values = append(values, parts[2])
+		added = append(added, v)
+	}
+
+	if len(slugs) == 0 {
+		return "", nil
+	}
+
+	query := `INSERT INTO clicks_breakdown (slug, dimension, value, count)
+		SELECT data.slug, data.dimension, data.value, data.added
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::bigint[]) AS data(slug, dimension, value, added)
+		WHERE EXISTS (SELECT 1 FROM urls WHERE urls.link_key = data.slug)
+		ON CONFLICT (slug, dimension, value) DO UPDATE SET count = clicks_breakdown.count + EXCLUDED.count`
+
+	return query, []any{pq.Array(slugs), pq.Array(dimensions), pq.Array(values), pq.Array(added)}
+}
+
 func ConvertToInt64(clicks map[string]string) (map[string]int64, error) {
 	mp := make(map[string]int64)
 
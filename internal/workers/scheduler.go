@@ -7,6 +7,7 @@ import (
 	"url-shortener/internal/config"
 	"url-shortener/internal/logger"
 	"url-shortener/internal/metrics"
+	"url-shortener/internal/safety"
 	"url-shortener/internal/storage"
 	"url-shortener/internal/utils/url"
 )
@@ -23,6 +24,9 @@ func Scheduler(stop context.Context, db storage.Database, cache storage.Cache, l
 	cacheFlushMetrics := time.NewTicker(cfg.Scheduler.MetricsFlushTimeout)
 	defer cacheFlushMetrics.Stop()
 
+	dbFlushVisitors := time.NewTicker(cfg.Scheduler.VisitorsFlushTimeout)
+	defer dbFlushVisitors.Stop()
+
 	for {
 		select {
 		case <-stop.Done():
@@ -46,63 +50,275 @@ func Scheduler(stop context.Context, db storage.Database, cache storage.Cache, l
 			logger.Info("Scheduler triggered flushing clicks")
 
 			timestamp := time.Now().Unix()
-			newKey := fmt.Sprintf("clicks:processing:%v", timestamp)
 
-			cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+			flushCounters(db, cache, logger, cfg, "clicks", timestamp, url_utils.BuildClicksArgs)
 
-			err := cache.RenameSetTTL(cacheCtx, "clicks", newKey, cfg.Cache.UrlExpiration)
-			cacheCancel()
+			flushCounters(db, cache, logger, cfg, "clicks_hourly", timestamp, url_utils.BuildHourlyArgs)
 
-			if err != nil {
-				logger.Error("Scheduler failed to proccess clicks:", err)
-				continue
+			flushCounters(db, cache, logger, cfg, "bot_clicks", timestamp, url_utils.BuildBotClicksArgs)
+
+			flushCounters(db, cache, logger, cfg, "breakdowns", timestamp, url_utils.BuildBreakdownArgs)
+		case <-dbFlushVisitors.C:
+			logger.Info("Scheduler triggered flushing unique visitors")
+
+			flushVisitors(db, cache, logger, cfg)
+		case <-cacheFlushMetrics.C:
+			cacheHits := metrics.CacheHitsCounter.Swap(0)
+			cacheMisses := metrics.CacheMissesCounter.Swap(0)
+
+			if cacheHits > 0 {
+				cachemetric.TotalCacheHits.Add(float64(cacheHits))
+			}
+
+			if cacheMisses > 0 {
+				cachemetric.TotalCacheMisses.Add(float64(cacheMisses))
 			}
+		}
+	}
+}
 
-			cacheCtx, cacheCancel = context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+// flushCounters moves a redis counter hash aside, persists it with the query built from it and drops it.
+// Readers add the copy being flushed to the live hash until it is dropped, a failed flush hands the
+// counts back to the live hash for the next one.
+func flushCounters(db storage.Database, cache storage.Cache, logger logger.Logger, cfg *config.Config, key string, timestamp int64, build func(map[string]int64) (string, []any)) {
+	newKey := fmt.Sprintf("%s:processing:%v", key, timestamp)
 
-			mp, err := cache.HashGetAll(cacheCtx, newKey)
-			cacheCancel()
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	moved, err := cache.StartFlush(cacheCtx, key, newKey, cfg.Cache.UrlExpiration)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to proccess", key+":", err)
+		return
+	}
+
+	if !moved {
+		return
+	}
+
+	cacheCtx, cacheCancel = context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	mp, err := cache.HashGetAll(cacheCtx, newKey)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to get data from cache:", err)
+		abortFlush(cache, logger, cfg, key, newKey)
+		return
+	}
+
+	counters, err := url_utils.ConvertToInt64(mp)
+
+	// Handing unparsable counts back would fail every later flush as well, so they are dropped
+	if err != nil {
+		logger.Error("Scheduler failed to parse", key+", dropping:", err)
+		finishFlush(cache, logger, cfg, key, newKey)
+		return
+	}
+
+	query, args := build(counters)
+
+	if query != "" {
+		dbCtx, dbCancel := context.WithTimeout(context.Background(), cfg.DB.Timeout)
+
+		err = db.StoreClicks(dbCtx, query, args...)
+		dbCancel()
+
+		if err != nil {
+			logger.Error("Scheduler failed to store", key+": key", newKey, "error:", err)
+			abortFlush(cache, logger, cfg, key, newKey)
+			return
+		}
+	}
+
+	if finishFlush(cache, logger, cfg, key, newKey) {
+		logger.Info("Scheduler successfully flushed", key)
+	}
+}
+
+func finishFlush(cache storage.Cache, logger logger.Logger, cfg *config.Config, key string, processingKey string) bool {
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	err := cache.FinishFlush(cacheCtx, key, processingKey)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to delete cached", key+":", err)
+	}
+
+	return err == nil
+}
+
+func abortFlush(cache storage.Cache, logger logger.Logger, cfg *config.Config, key string, processingKey string) {
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	err := cache.AbortFlush(cacheCtx, key, processingKey)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to hand back", key+":", err)
+	}
+}
+
+// flushVisitors claims the links whose sketches changed and stores their counts, a failed round
+// hands the links back for the next one
+func flushVisitors(db storage.Database, cache storage.Cache, logger logger.Logger, cfg *config.Config) {
+	processingKey := fmt.Sprintf("visitors:dirty:processing:%v", time.Now().UnixNano())
+
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	slugs, err := cache.ClaimVisitorSlugs(cacheCtx, processingKey, cfg.Cache.UrlExpiration)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to get visited slugs:", err)
+		return
+	}
+
+	if len(slugs) == 0 {
+		return
+	}
+
+	stored := storeVisitors(db, cache, logger, cfg, slugs)
+
+	cacheCtx, cacheCancel = context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	err = cache.ReleaseVisitorSlugs(cacheCtx, processingKey, stored)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to release visited slugs:", err)
+	}
+}
+
+func storeVisitors(db storage.Database, cache storage.Cache, logger logger.Logger, cfg *config.Config, slugs []string) bool {
+	cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+
+	visitors, err := cache.CountVisitors(cacheCtx, slugs...)
+	cacheCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to count unique visitors:", err)
+		return false
+	}
+
+	query, args := url_utils.BuildVisitorsArgs(visitors)
+
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), cfg.DB.Timeout)
+
+	err = db.StoreClicks(dbCtx, query, args...)
+	dbCancel()
+
+	if err != nil {
+		logger.Error("Scheduler failed to store unique visitors:", err)
+		return false
+	}
+
+	logger.Info("Scheduler successfully flushed unique visitors:", len(visitors))
+
+	return true
+}
+
+// SafetyRechecker runs every live link through the checker again, destinations can turn bad after
+// they were shortened and the blocklist keeps growing. Flagged links are disabled, not deleted.
+// Each round stops after the configured budget and the next one resumes where it left off.
+func SafetyRechecker(stop context.Context, db storage.Database, cache storage.Cache, logger logger.Logger, cfg *config.Config, checker safety.SafetyChecker) {
+	logger.Info("Safety rechecker started")
+
+	ticker := time.NewTicker(cfg.Scheduler.SafetyRecheckTimeout)
+	defer ticker.Stop()
+
+	var afterID int64
+
+	for {
+		select {
+		case <-stop.Done():
+			logger.Info("Safety rechecker stopped")
+			return
+		case <-ticker.C:
+			logger.Info("Safety re-check triggered, resuming after id:", afterID)
+
+			afterID = recheckSafety(stop, db, cache, logger, cfg, checker, afterID)
+		}
+	}
+}
+
+// recheckSafety checks links after afterID until the budget runs out and returns the id to resume
+// after, 0 once every link was checked
+func recheckSafety(stop context.Context, db storage.Database, cache storage.Cache, logger logger.Logger, cfg *config.Config, checker safety.SafetyChecker, afterID int64) int64 {
+	ctx, cancel := context.WithTimeout(stop, cfg.Safety.RecheckBudget)
+	defer cancel()
+
+	checked, disabled := 0, 0
+
+	defer func() {
+		logger.Info("Safety re-check round finished, checked:", checked, "disabled:", disabled)
+	}()
+
+	for ctx.Err() == nil {
+		dbCtx, dbCancel := context.WithTimeout(ctx, cfg.DB.Timeout)
+
+		urls, err := db.ListActiveUrls(dbCtx, afterID, cfg.Safety.RecheckBatch)
+		dbCancel()
+
+		if err != nil {
+			logger.Error("Failed to list urls for safety re-check:", err)
+			return afterID
+		}
+
+		for _, url := range urls {
+			reason, err := checker.Check(ctx, url.LongUrl)
+
+			if err == nil && reason == "" {
+				reason, err = safety.CheckRules(ctx, checker, url.Rules)
+			}
+
+			// The link cut off by the budget is checked first next round
+			if ctx.Err() != nil {
+				return afterID
+			}
+
+			afterID = url.ID
+			checked++
 
 			if err != nil {
-				logger.Error("Scheduler failed to get data from cache:", err)
+				logger.Warn("Safety re-check error:", url.Key, err)
 				continue
 			}
 
-			clicks, err := url_utils.ConvertToInt64(mp)
-
-			query, args := url_utils.BuildClicksArgs(clicks)
+			if reason == "" {
+				continue
+			}
 
 			dbCtx, dbCancel := context.WithTimeout(context.Background(), cfg.DB.Timeout)
 
-			err = db.StoreClicks(dbCtx, query, args...)
+			err = db.DisableUrl(dbCtx, url.Key, reason)
 			dbCancel()
 
 			if err != nil {
-				logger.Error("Scheduler failed to store clicks: key", newKey, "error:", err)
+				logger.Error("Failed to disable url:", url.Key, err)
 				continue
 			}
 
-			cacheCtx, cacheCancel = context.WithTimeout(context.Background(), cfg.Cache.Timeout)
+			// Without this the cached record keeps redirecting until it expires
+			cacheCtx, cacheCancel := context.WithTimeout(context.Background(), cfg.Cache.Timeout)
 
-			err = cache.Delete(cacheCtx, newKey)
+			err = cache.DeleteUrl(cacheCtx, url.Key)
 			cacheCancel()
 
 			if err != nil {
-				logger.Error("Scheduler failed to delete cached clicks:", err)
-			} else {
-				logger.Info("Scheduler successfully flushed clicks")
+				logger.Error("Failed to invalidate disabled url:", url.Key, err)
 			}
-		case <-cacheFlushMetrics.C:
-			cacheHits := metrics.CacheHitsCounter.Swap(0)
-			cacheMisses := metrics.CacheMissesCounter.Swap(0)
 
-			if cacheHits > 0 {
-				cachemetric.TotalCacheHits.Add(float64(cacheHits))
-			}
+			disabled++
+			logger.Warn("Safety re-check disabled url:", url.Key, reason)
+		}
 
-			if cacheMisses > 0 {
-				cachemetric.TotalCacheMisses.Add(float64(cacheMisses))
-			}
+		if len(urls) < cfg.Safety.RecheckBatch {
+			return 0
 		}
 	}
+
+	return afterID
 }